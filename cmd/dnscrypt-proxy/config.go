@@ -5,12 +5,15 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -51,15 +54,23 @@ type Config struct {
 	CacheNegMaxTTL           uint32                              `toml:"cache_neg_max_ttl"`
 	CacheMinTTL              uint32                              `toml:"cache_min_ttl"`
 	CacheMaxTTL              uint32                              `toml:"cache_max_ttl"`
+	CacheSnapshotFile        string                              `toml:"cache_snapshot_file"`
+	CacheSnapshotInterval    int                                 `toml:"cache_snapshot_interval"`
+	CacheStaleMaxAge         uint32                              `toml:"cache_stale_max_age"`
+	CacheStaleTTL            uint32                              `toml:"cache_stale_ttl"`
+	CachePrefetch            bool                                `toml:"cache_prefetch"`
 	RejectTTL                uint32                              `toml:"reject_ttl"`
 	CloakTTL                 uint32                              `toml:"cloak_ttl"`
 	QueryLog                 QueryLogConfig                      `toml:"query_log"`
 	NxLog                    NxLogConfig                         `toml:"nx_log"`
+	Dnstap                   DnstapConfig                        `toml:"dnstap"`
 	BlockName                BlockNameConfig                     `toml:"blacklist"`
 	WhitelistName            WhitelistNameConfig                 `toml:"whitelist"`
 	BlockIP                  BlockIPConfig                       `toml:"ip_blacklist"`
+	RPZ                      RPZConfig                           `toml:"rpz"`
 	ForwardFile              string                              `toml:"forwarding_rules"`
 	CloakFile                string                              `toml:"cloaking_rules"`
+	WatchRulesFiles          bool                                `toml:"watch_rules_files"`
 	StaticsConfig            map[string]StaticConfig             `toml:"static"`
 	SourcesConfig            map[string]SourceConfig             `toml:"sources"`
 	SourceRequireDNSSEC      bool                                `toml:"require_dnssec"`
@@ -67,12 +78,19 @@ type Config struct {
 	SourceRequireNoFilter    bool                                `toml:"require_nofilter"`
 	SourceDNSCrypt           bool                                `toml:"dnscrypt_servers"`
 	SourceDoH                bool                                `toml:"doh_servers"`
+	SourceDoT                bool                                `toml:"tls_servers"`
+	SourcePlain              bool                                `toml:"plain_servers"`
+	SourceODoH               bool                                `toml:"odoh_servers"`
 	SourceIPv4               bool                                `toml:"ipv4_servers"`
 	SourceIPv6               bool                                `toml:"ipv6_servers"`
 	MaxClients               uint32                              `toml:"max_clients"`
 	FallbackResolver         string                              `toml:"fallback_resolver"`
 	IgnoreSystemDNS          bool                                `toml:"ignore_system_dns"`
 	AllWeeklyRanges          map[string]dnscrypt.WeeklyRangesStr `toml:"schedules"`
+	ClientGroups             map[string]ClientGroupConfig        `toml:"client_groups"`
+	ClientIDNetworks         []string                            `toml:"client_id_networks"`
+	ClientACL                ClientACLConfig                     `toml:"client_acl"`
+	RateLimit                RateLimitConfig                     `toml:"rate_limit"`
 	LogMaxSize               int                                 `toml:"log_files_max_size"`
 	LogMaxAge                int                                 `toml:"log_files_max_age"`
 	LogMaxBackups            int                                 `toml:"log_files_max_backups"`
@@ -86,6 +104,10 @@ type Config struct {
 	BlockedQueryResponse     string                              `toml:"blocked_query_response"`
 	QueryMeta                []string                            `toml:"query_meta"`
 	AnonymizedDNS            AnonymizedDNSConfig                 `toml:"anonymized_dns"`
+	LocalDoH                 LocalDoHConfig                      `toml:"local_doh"`
+	LocalDoT                 LocalDoTConfig                      `toml:"local_dot"`
+	AdminAPI                 AdminAPIConfig                      `toml:"admin_api"`
+	Metrics                  MetricsConfig                       `toml:"metrics"`
 }
 
 func newConfig() Config {
@@ -104,6 +126,10 @@ func newConfig() Config {
 		CacheNegMaxTTL:           600,
 		CacheMinTTL:              60,
 		CacheMaxTTL:              86400,
+		CacheSnapshotInterval:    10,
+		CacheStaleMaxAge:         0,
+		CacheStaleTTL:            30,
+		CachePrefetch:            false,
 		RejectTTL:                600,
 		CloakTTL:                 600,
 		SourceRequireNoLog:       true,
@@ -112,6 +138,9 @@ func newConfig() Config {
 		SourceIPv6:               false,
 		SourceDNSCrypt:           true,
 		SourceDoH:                true,
+		SourceDoT:                false,
+		SourcePlain:              false,
+		SourceODoH:               false,
 		MaxClients:               250,
 		FallbackResolver:         dnscrypt.DefaultFallbackResolver,
 		IgnoreSystemDNS:          false,
@@ -125,6 +154,7 @@ func newConfig() Config {
 		RefusedCodeInResponses:   false,
 		LBEstimator:              true,
 		BlockedQueryResponse:     "hinfo",
+		WatchRulesFiles:          false,
 	}
 }
 
@@ -153,6 +183,13 @@ type NxLogConfig struct {
 	Format string
 }
 
+type DnstapConfig struct {
+	Socket   string `toml:"socket"`
+	Address  string `toml:"address"`
+	File     string `toml:"file"`
+	Identity string `toml:"identity"`
+}
+
 type BlockNameConfig struct {
 	File    string `toml:"blacklist_file"`
 	LogFile string `toml:"log_file"`
@@ -171,6 +208,41 @@ type BlockIPConfig struct {
 	Format  string `toml:"log_format"`
 }
 
+type RPZConfig struct {
+	ZoneFiles []string `toml:"zone_files"`
+}
+
+type ClientGroupConfig struct {
+	IPs                  []string                            `toml:"ips"`
+	ClientIDs            []string                            `toml:"client_ids"`
+	BlacklistFile        string                              `toml:"blacklist_file"`
+	WhitelistFile        string                              `toml:"whitelist_file"`
+	CloakFile            string                              `toml:"cloaking_rules"`
+	BlockedQueryResponse string                              `toml:"blocked_query_response"`
+	AllWeeklyRanges      map[string]dnscrypt.WeeklyRangesStr `toml:"schedules"`
+	RateLimit            *RateLimitConfig                    `toml:"rate_limit"`
+}
+
+type ClientACLListenerConfig struct {
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+}
+
+type ClientACLConfig struct {
+	Allow     []string                           `toml:"allow"`
+	Deny      []string                           `toml:"deny"`
+	Action    string                             `toml:"action"`
+	Listeners map[string]ClientACLListenerConfig `toml:"listeners"`
+}
+
+type RateLimitConfig struct {
+	QueriesPerSecond float64 `toml:"queries_per_second"`
+	Burst            float64 `toml:"burst"`
+	IPv4Prefix       int     `toml:"ipv4_prefix"`
+	IPv6Prefix       int     `toml:"ipv6_prefix"`
+	Action           string  `toml:"action"`
+}
+
 type AnonymizedDNSRouteConfig struct {
 	ServerName string   `toml:"server_name"`
 	RelayNames []string `toml:"via"`
@@ -180,6 +252,29 @@ type AnonymizedDNSConfig struct {
 	Routes []AnonymizedDNSRouteConfig `toml:"routes"`
 }
 
+type LocalDoHConfig struct {
+	ListenAddresses []string `toml:"listen_addresses"`
+	Path            string   `toml:"path"`
+	CertFile        string   `toml:"cert_file"`
+	CertKeyFile     string   `toml:"cert_key_file"`
+}
+
+type LocalDoTConfig struct {
+	ListenAddresses []string `toml:"listen_addresses"`
+	CertFile        string   `toml:"cert_file"`
+	CertKeyFile     string   `toml:"cert_key_file"`
+}
+
+type AdminAPIConfig struct {
+	ListenAddresses []string `toml:"listen_addresses"`
+	Token           string   `toml:"token"`
+}
+
+type MetricsConfig struct {
+	ListenAddresses []string `toml:"listen_addresses"`
+	Path            string   `toml:"path"`
+}
+
 type ServerSummary struct {
 	Name        string   `json:"name"`
 	Proto       string   `json:"proto"`
@@ -355,6 +450,47 @@ func ConfigLoad(proxy *dnscrypt.Proxy, svcFlag *string) error {
 	proxy.ServersInfo.LBEstimator = config.LBEstimator
 
 	proxy.ListenAddresses = config.ListenAddresses
+	if err := config.loadClientACLs(proxy); err != nil {
+		return err
+	}
+	if len(config.LocalDoH.ListenAddresses) > 0 {
+		if len(config.LocalDoH.CertFile) == 0 || len(config.LocalDoH.CertKeyFile) == 0 {
+			return errors.New("A certificate and a key are required to start a local DoH service")
+		}
+		if len(config.LocalDoH.Path) == 0 {
+			config.LocalDoH.Path = dnscrypt.DefaultLocalDoHPath
+		} else if !strings.HasPrefix(config.LocalDoH.Path, "/") {
+			return fmt.Errorf("Invalid local DoH path [%s] -- The path must start with a slash", config.LocalDoH.Path)
+		}
+		proxy.LocalDoHListenAddresses = config.LocalDoH.ListenAddresses
+		proxy.LocalDoHPath = config.LocalDoH.Path
+		proxy.LocalDoHCertFile = config.LocalDoH.CertFile
+		proxy.LocalDoHCertKeyFile = config.LocalDoH.CertKeyFile
+	}
+	if len(config.LocalDoT.ListenAddresses) > 0 {
+		if len(config.LocalDoT.CertFile) == 0 || len(config.LocalDoT.CertKeyFile) == 0 {
+			return errors.New("A certificate and a key are required to start a local DoT service")
+		}
+		proxy.LocalDoTListenAddresses = config.LocalDoT.ListenAddresses
+		proxy.LocalDoTCertFile = config.LocalDoT.CertFile
+		proxy.LocalDoTCertKeyFile = config.LocalDoT.CertKeyFile
+	}
+	if len(config.AdminAPI.ListenAddresses) > 0 {
+		if len(config.AdminAPI.Token) == 0 {
+			return errors.New("A token is required to start the admin API")
+		}
+		proxy.AdminAPIListenAddresses = config.AdminAPI.ListenAddresses
+		proxy.AdminAPIToken = config.AdminAPI.Token
+	}
+	if len(config.Metrics.ListenAddresses) > 0 {
+		if len(config.Metrics.Path) == 0 {
+			config.Metrics.Path = dnscrypt.DefaultMetricsPath
+		} else if !strings.HasPrefix(config.Metrics.Path, "/") {
+			return fmt.Errorf("Invalid metrics path [%s] -- The path must start with a slash", config.Metrics.Path)
+		}
+		proxy.MetricsListenAddresses = config.Metrics.ListenAddresses
+		proxy.MetricsPath = config.Metrics.Path
+	}
 	proxy.Daemonize = config.Daemonize
 	proxy.PluginBlockIPv6 = config.BlockIPv6
 	proxy.Cache = config.Cache
@@ -370,6 +506,11 @@ func ConfigLoad(proxy *dnscrypt.Proxy, svcFlag *string) error {
 
 	proxy.CacheMinTTL = config.CacheMinTTL
 	proxy.CacheMaxTTL = config.CacheMaxTTL
+	proxy.CacheSnapshotFile = config.CacheSnapshotFile
+	proxy.CacheSnapshotInterval = time.Duration(config.CacheSnapshotInterval) * time.Minute
+	proxy.CacheStaleMaxAge = config.CacheStaleMaxAge
+	proxy.CacheStaleTTL = config.CacheStaleTTL
+	proxy.CachePrefetch = config.CachePrefetch
 	proxy.RejectTTL = config.RejectTTL
 	proxy.CloakTTL = config.CloakTTL
 
@@ -380,7 +521,7 @@ func ConfigLoad(proxy *dnscrypt.Proxy, svcFlag *string) error {
 	} else {
 		config.QueryLog.Format = strings.ToLower(config.QueryLog.Format)
 	}
-	if config.QueryLog.Format != "tsv" && config.QueryLog.Format != "ltsv" {
+	if !isValidLogFormat(config.QueryLog.Format) {
 		return errors.New("Unsupported query log format")
 	}
 	proxy.QueryLogFile = config.QueryLog.File
@@ -392,18 +533,34 @@ func ConfigLoad(proxy *dnscrypt.Proxy, svcFlag *string) error {
 	} else {
 		config.NxLog.Format = strings.ToLower(config.NxLog.Format)
 	}
-	if config.NxLog.Format != "tsv" && config.NxLog.Format != "ltsv" {
+	if !isValidLogFormat(config.NxLog.Format) {
 		return errors.New("Unsupported NX log format")
 	}
 	proxy.NXLogFile = config.NxLog.File
 	proxy.NXLogFormat = config.NxLog.Format
 
+	dnstapOutputs := 0
+	for _, output := range []struct {
+		network string
+		address string
+	}{{"unix", config.Dnstap.Socket}, {"tcp", config.Dnstap.Address}, {"file", config.Dnstap.File}} {
+		if len(output.address) > 0 {
+			proxy.DnstapNetwork = output.network
+			proxy.DnstapAddress = output.address
+			dnstapOutputs++
+		}
+	}
+	if dnstapOutputs > 1 {
+		return errors.New("Only one of socket, address and file can be set for dnstap")
+	}
+	proxy.DnstapIdentity = config.Dnstap.Identity
+
 	if len(config.BlockName.Format) == 0 {
 		config.BlockName.Format = "tsv"
 	} else {
 		config.BlockName.Format = strings.ToLower(config.BlockName.Format)
 	}
-	if config.BlockName.Format != "tsv" && config.BlockName.Format != "ltsv" {
+	if !isValidLogFormat(config.BlockName.Format) {
 		return errors.New("Unsupported block log format")
 	}
 	proxy.BlockNameFile = config.BlockName.File
@@ -415,7 +572,7 @@ func ConfigLoad(proxy *dnscrypt.Proxy, svcFlag *string) error {
 	} else {
 		config.WhitelistName.Format = strings.ToLower(config.WhitelistName.Format)
 	}
-	if config.WhitelistName.Format != "tsv" && config.WhitelistName.Format != "ltsv" {
+	if !isValidLogFormat(config.WhitelistName.Format) {
 		return errors.New("Unsupported whitelist log format")
 	}
 	proxy.WhitelistNameFile = config.WhitelistName.File
@@ -427,21 +584,32 @@ func ConfigLoad(proxy *dnscrypt.Proxy, svcFlag *string) error {
 	} else {
 		config.BlockIP.Format = strings.ToLower(config.BlockIP.Format)
 	}
-	if config.BlockIP.Format != "tsv" && config.BlockIP.Format != "ltsv" {
+	if !isValidLogFormat(config.BlockIP.Format) {
 		return errors.New("Unsupported IP block log format")
 	}
 	proxy.BlockIPFile = config.BlockIP.File
 	proxy.BlockIPFormat = config.BlockIP.Format
 	proxy.BlockIPLogFile = config.BlockIP.LogFile
 
+	proxy.RPZZoneFiles = config.RPZ.ZoneFiles
+
 	proxy.ForwardFile = config.ForwardFile
 	proxy.CloakFile = config.CloakFile
+	proxy.WatchRulesFiles = config.WatchRulesFiles
 
 	allWeeklyRanges, err := dnscrypt.ParseAllWeeklyRanges(config.AllWeeklyRanges)
 	if err != nil {
 		return err
 	}
 	proxy.AllWeeklyRanges = allWeeklyRanges
+	if err := config.loadClientGroups(proxy); err != nil {
+		return err
+	}
+	rateLimit, err := newRateLimit(&config.RateLimit)
+	if err != nil {
+		return fmt.Errorf("%s in the rate limit", err)
+	}
+	proxy.RateLimit = rateLimit
 
 	if configRoutes := config.AnonymizedDNS.Routes; configRoutes != nil {
 		routes := make(map[string][]string)
@@ -461,6 +629,9 @@ func ConfigLoad(proxy *dnscrypt.Proxy, svcFlag *string) error {
 		config.SourceIPv6 = true
 		config.SourceDNSCrypt = true
 		config.SourceDoH = true
+		config.SourceDoT = true
+		config.SourcePlain = true
+		config.SourceODoH = true
 	}
 
 	netprobeTimeout := config.NetprobeTimeout
@@ -478,6 +649,10 @@ func ConfigLoad(proxy *dnscrypt.Proxy, svcFlag *string) error {
 	proxy.ShowCerts = *showCerts || len(os.Getenv("SHOW_CERTS")) > 0
 	if proxy.ShowCerts {
 		proxy.ListenAddresses = proxy.ListenAddresses[0:0]
+		proxy.LocalDoHListenAddresses = proxy.LocalDoHListenAddresses[0:0]
+		proxy.LocalDoTListenAddresses = proxy.LocalDoTListenAddresses[0:0]
+		proxy.AdminAPIListenAddresses = proxy.AdminAPIListenAddresses[0:0]
+		proxy.MetricsListenAddresses = proxy.MetricsListenAddresses[0:0]
 	}
 	dlog.Noticef("dnscrypt-proxy %s", AppVersion)
 	if err := dnscrypt.NetProbe(netprobeAddress, netprobeTimeout); err != nil {
@@ -499,8 +674,8 @@ func ConfigLoad(proxy *dnscrypt.Proxy, svcFlag *string) error {
 		hasSpecificRoutes := false
 		for _, server := range proxy.RegisteredServers {
 			if via, ok := (*proxy.Routes)[server.Name]; ok {
-				if server.Stamp.Proto != stamps.StampProtoTypeDNSCrypt {
-					dlog.Errorf("DNS anonymization is only supported with the DNSCrypt protocol - Connections to [%v] cannot be anonymized", server.Name)
+				if server.Stamp.Proto != stamps.StampProtoTypeDNSCrypt && server.Stamp.Proto != dnscrypt.StampProtoTypeODoHTarget {
+					dlog.Errorf("DNS anonymization is only supported with the DNSCrypt and ODoH protocols - Connections to [%v] cannot be anonymized", server.Name)
 				} else {
 					dlog.Noticef("Anonymized DNS: routing [%v] via %v", server.Name, via)
 				}
@@ -529,7 +704,8 @@ func (config *Config) printRegisteredServers(proxy *dnscrypt.Proxy, jsonOutput b
 		var hostAddr string
 		hostAddr, port = dnscrypt.ExtractHostAndPort(addrStr, port)
 		addrs := make([]string, 0)
-		if registeredServer.Stamp.Proto == stamps.StampProtoTypeDoH && len(registeredServer.Stamp.ProviderName) > 0 {
+		if (registeredServer.Stamp.Proto == stamps.StampProtoTypeDoH || registeredServer.Stamp.Proto == stamps.StampProtoTypeTLS ||
+			registeredServer.Stamp.Proto == dnscrypt.StampProtoTypeODoHTarget) && len(registeredServer.Stamp.ProviderName) > 0 {
 			providerName := registeredServer.Stamp.ProviderName
 			var host string
 			host, port = dnscrypt.ExtractHostAndPort(providerName, port)
@@ -540,7 +716,7 @@ func (config *Config) printRegisteredServers(proxy *dnscrypt.Proxy, jsonOutput b
 		}
 		serverSummary := ServerSummary{
 			Name:        registeredServer.Name,
-			Proto:       registeredServer.Stamp.Proto.String(),
+			Proto:       dnscrypt.StampProtoString(registeredServer.Stamp.Proto),
 			IPv6:        strings.HasPrefix(addrStr, "["),
 			Ports:       []int{port},
 			Addrs:       addrs,
@@ -548,7 +724,7 @@ func (config *Config) printRegisteredServers(proxy *dnscrypt.Proxy, jsonOutput b
 			NoLog:       registeredServer.Stamp.Props&stamps.ServerInformalPropertyNoLog != 0,
 			NoFilter:    registeredServer.Stamp.Props&stamps.ServerInformalPropertyNoFilter != 0,
 			Description: registeredServer.Description,
-			Stamp:       registeredServer.Stamp.String(),
+			Stamp:       dnscrypt.ServerStampString(&registeredServer.Stamp),
 		}
 		if jsonOutput {
 			summary = append(summary, serverSummary)
@@ -594,10 +770,17 @@ func (config *Config) loadSources(proxy *dnscrypt.Proxy) error {
 		if len(staticConfig.Stamp) == 0 {
 			dlog.Fatalf("Missing stamp for the static [%s] definition", serverName)
 		}
-		stamp, err := stamps.NewServerStampFromString(staticConfig.Stamp)
+		stamp, err := dnscrypt.NewServerStampFromString(staticConfig.Stamp)
 		if err != nil {
 			dlog.Fatalf("Stamp error for the static [%s] definition: [%v]", serverName, err)
 		}
+		if stamp.Proto == stamps.StampProtoTypePlain {
+			if !config.SourcePlain {
+				dlog.Errorf("[%s] is a plain DNS server, but `plain_servers` is not enabled -- Ignoring it", serverName)
+				continue
+			}
+			dlog.Warnf("[%s] is a plain DNS server -- Queries sent to it will NOT be encrypted", serverName)
+		}
 		proxy.RegisteredServers = append(proxy.RegisteredServers,
 			dnscrypt.RegisteredServer{Name: serverName, Stamp: stamp})
 	}
@@ -643,7 +826,8 @@ func (config *Config) loadSource(proxy *dnscrypt.Proxy, requiredProps stamps.Ser
 		dlog.Warnf("Error in source [%s]: [%s] -- Continuing with reduced server count [%d]", cfgSourceName, err, len(registeredServers))
 	}
 	for _, registeredServer := range registeredServers {
-		if registeredServer.Stamp.Proto != stamps.StampProtoTypeDNSCryptRelay {
+		isRelay := registeredServer.Stamp.Proto == stamps.StampProtoTypeDNSCryptRelay || registeredServer.Stamp.Proto == dnscrypt.StampProtoTypeODoHRelay
+		if !isRelay {
 			if len(config.ServerNames) > 0 {
 				if !includesName(config.ServerNames, registeredServer.Name) {
 					continue
@@ -657,7 +841,9 @@ func (config *Config) loadSource(proxy *dnscrypt.Proxy, requiredProps stamps.Ser
 		}
 		if config.SourceIPv4 || config.SourceIPv6 {
 			isIPv4, isIPv6 := true, false
-			if registeredServer.Stamp.Proto == stamps.StampProtoTypeDoH {
+			if registeredServer.Stamp.Proto == stamps.StampProtoTypeDoH || registeredServer.Stamp.Proto == dnscrypt.StampProtoTypeODoHTarget ||
+				((registeredServer.Stamp.Proto == stamps.StampProtoTypeTLS || registeredServer.Stamp.Proto == dnscrypt.StampProtoTypeODoHRelay) &&
+					len(registeredServer.Stamp.ServerAddrStr) == 0) {
 				isIPv4, isIPv6 = true, true
 			}
 			if strings.HasPrefix(registeredServer.Stamp.ServerAddrStr, "[") {
@@ -667,14 +853,20 @@ func (config *Config) loadSource(proxy *dnscrypt.Proxy, requiredProps stamps.Ser
 				continue
 			}
 		}
-		if registeredServer.Stamp.Proto == stamps.StampProtoTypeDNSCryptRelay {
+		if isRelay {
 			dlog.Debugf("Adding [%s] to the set of available relays", registeredServer.Name)
 			proxy.RegisteredRelays = append(proxy.RegisteredRelays, registeredServer)
 		} else {
 			if !((config.SourceDNSCrypt && registeredServer.Stamp.Proto == stamps.StampProtoTypeDNSCrypt) ||
-				(config.SourceDoH && registeredServer.Stamp.Proto == stamps.StampProtoTypeDoH)) {
+				(config.SourceDoH && registeredServer.Stamp.Proto == stamps.StampProtoTypeDoH) ||
+				(config.SourceDoT && registeredServer.Stamp.Proto == stamps.StampProtoTypeTLS) ||
+				(config.SourcePlain && registeredServer.Stamp.Proto == stamps.StampProtoTypePlain) ||
+				(config.SourceODoH && registeredServer.Stamp.Proto == dnscrypt.StampProtoTypeODoHTarget)) {
 				continue
 			}
+			if registeredServer.Stamp.Proto == stamps.StampProtoTypePlain {
+				dlog.Warnf("[%s] is a plain DNS server -- Queries sent to it will NOT be encrypted", registeredServer.Name)
+			}
 			dlog.Debugf("Adding [%s] to the set of wanted resolvers", registeredServer.Name)
 			proxy.RegisteredServers = append(proxy.RegisteredServers, registeredServer)
 		}
@@ -682,6 +874,176 @@ func (config *Config) loadSource(proxy *dnscrypt.Proxy, requiredProps stamps.Ser
 	return nil
 }
 
+func (config *Config) loadClientGroups(proxy *dnscrypt.Proxy) error {
+	clientIDNetworks, err := parseIPNetworks(config.ClientIDNetworks)
+	if err != nil {
+		return fmt.Errorf("%s in `client_id_networks`", err)
+	}
+	proxy.ClientIDNetworks = clientIDNetworks
+	groupNames := make([]string, 0, len(config.ClientGroups))
+	for groupName := range config.ClientGroups {
+		groupNames = append(groupNames, groupName)
+	}
+	sort.Strings(groupNames)
+	for _, groupName := range groupNames {
+		groupConfig := config.ClientGroups[groupName]
+		if len(groupConfig.IPs) == 0 && len(groupConfig.ClientIDs) == 0 {
+			return fmt.Errorf("No IPs or client IDs defined for the [%s] client group", groupName)
+		}
+		if len(groupConfig.ClientIDs) > 0 && len(clientIDNetworks) == 0 {
+			dlog.Warnf("No `client_id_networks` defined, so the client IDs of the [%s] client group are ignored", groupName)
+		}
+		clientGroup := &dnscrypt.ClientGroup{
+			Name:                 groupName,
+			ClientIDs:            groupConfig.ClientIDs,
+			BlockNameFile:        groupConfig.BlacklistFile,
+			WhitelistNameFile:    groupConfig.WhitelistFile,
+			CloakFile:            groupConfig.CloakFile,
+			BlockedQueryResponse: groupConfig.BlockedQueryResponse,
+		}
+		networks, err := parseIPNetworks(groupConfig.IPs)
+		if err != nil {
+			return fmt.Errorf("%s for the [%s] client group", err, groupName)
+		}
+		clientGroup.Networks = networks
+		allWeeklyRangesStr := make(map[string]dnscrypt.WeeklyRangesStr)
+		for name, weeklyRangesStr := range config.AllWeeklyRanges {
+			allWeeklyRangesStr[name] = weeklyRangesStr
+		}
+		for name, weeklyRangesStr := range groupConfig.AllWeeklyRanges {
+			allWeeklyRangesStr[name] = weeklyRangesStr
+		}
+		allWeeklyRanges, err := dnscrypt.ParseAllWeeklyRanges(allWeeklyRangesStr)
+		if err != nil {
+			return err
+		}
+		clientGroup.AllWeeklyRanges = allWeeklyRanges
+		if groupConfig.RateLimit != nil {
+			rateLimit, err := newRateLimit(groupConfig.RateLimit)
+			if err != nil {
+				return fmt.Errorf("%s in the rate limit of the [%s] client group", err, groupName)
+			}
+			if rateLimit == nil {
+				rateLimit = &dnscrypt.RateLimit{}
+			}
+			if len(groupConfig.IPs) == 0 {
+				dlog.Warnf("The [%s] client group has no IPs, so its rate limit doesn't apply", groupName)
+			}
+			clientGroup.RateLimit = rateLimit
+		}
+		proxy.ClientGroups = append(proxy.ClientGroups, clientGroup)
+	}
+	return nil
+}
+
+func (config *Config) loadClientACLs(proxy *dnscrypt.Proxy) error {
+	aclConfig := config.ClientACL
+	switch strings.ToLower(aclConfig.Action) {
+	case "", dnscrypt.DeniedClientActionDrop:
+		proxy.DeniedClientAction = dnscrypt.DeniedClientActionDrop
+	case dnscrypt.DeniedClientActionRefused:
+		proxy.DeniedClientAction = dnscrypt.DeniedClientActionRefused
+	default:
+		return fmt.Errorf("Unsupported action for denied clients: [%s]", aclConfig.Action)
+	}
+	acl, err := newClientACL(aclConfig.Allow, aclConfig.Deny)
+	if err != nil {
+		return fmt.Errorf("%s in the client ACL", err)
+	}
+	proxy.ClientACL = acl
+	proxy.ListenerClientACLs = make(map[string]*dnscrypt.ClientACL)
+	for listenAddrStr, listenerConfig := range aclConfig.Listeners {
+		if !includesName(config.ListenAddresses, listenAddrStr) {
+			dlog.Warnf("Client ACL defined for [%s], which is not in `listen_addresses`", listenAddrStr)
+		}
+		acl, err := newClientACL(listenerConfig.Allow, listenerConfig.Deny)
+		if err != nil {
+			return fmt.Errorf("%s in the client ACL of [%s]", err, listenAddrStr)
+		}
+		if acl == nil {
+			acl = &dnscrypt.ClientACL{}
+		}
+		proxy.ListenerClientACLs[listenAddrStr] = acl
+	}
+	return nil
+}
+
+// newClientACL returns nil if no networks are allowed or denied
+func newClientACL(allow []string, deny []string) (*dnscrypt.ClientACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	allowed, err := parseIPNetworks(allow)
+	if err != nil {
+		return nil, err
+	}
+	denied, err := parseIPNetworks(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &dnscrypt.ClientACL{Allowed: allowed, Denied: denied}, nil
+}
+
+// newRateLimit returns nil if no queries per second are set
+func newRateLimit(rateLimitConfig *RateLimitConfig) (*dnscrypt.RateLimit, error) {
+	if rateLimitConfig.QueriesPerSecond <= 0 {
+		return nil, nil
+	}
+	rateLimit := &dnscrypt.RateLimit{
+		QueriesPerSecond: rateLimitConfig.QueriesPerSecond,
+		Burst:            rateLimitConfig.Burst,
+		IPv4PrefixLen:    rateLimitConfig.IPv4Prefix,
+		IPv6PrefixLen:    rateLimitConfig.IPv6Prefix,
+	}
+	if rateLimit.Burst <= 0 {
+		rateLimit.Burst = math.Max(rateLimit.QueriesPerSecond, 1)
+	} else if rateLimit.Burst < 1 {
+		return nil, fmt.Errorf("Invalid burst [%g], at least 1 query is required", rateLimit.Burst)
+	}
+	if rateLimit.IPv4PrefixLen == 0 {
+		rateLimit.IPv4PrefixLen = 32
+	} else if rateLimit.IPv4PrefixLen < 0 || rateLimit.IPv4PrefixLen > 32 {
+		return nil, fmt.Errorf("Invalid IPv4 prefix length [%d]", rateLimit.IPv4PrefixLen)
+	}
+	if rateLimit.IPv6PrefixLen == 0 {
+		rateLimit.IPv6PrefixLen = 56
+	} else if rateLimit.IPv6PrefixLen < 0 || rateLimit.IPv6PrefixLen > 128 {
+		return nil, fmt.Errorf("Invalid IPv6 prefix length [%d]", rateLimit.IPv6PrefixLen)
+	}
+	switch strings.ToLower(rateLimitConfig.Action) {
+	case "", dnscrypt.RateLimitActionTruncate:
+		rateLimit.Action = dnscrypt.RateLimitActionTruncate
+	case dnscrypt.RateLimitActionRefused:
+		rateLimit.Action = dnscrypt.RateLimitActionRefused
+	case dnscrypt.RateLimitActionDrop:
+		rateLimit.Action = dnscrypt.RateLimitActionDrop
+	default:
+		return nil, fmt.Errorf("Unsupported action [%s]", rateLimitConfig.Action)
+	}
+	return rateLimit, nil
+}
+
+// parseIPNetworks parses a list of networks in CIDR notation, IP addresses being turned into single-host networks
+func parseIPNetworks(ipStrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, ipStr := range ipStrs {
+		cidr := ipStr
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid IP or network [%s]", ipStr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 func includesName(names []string, name string) bool {
 	for _, found := range names {
 		if strings.EqualFold(found, name) {
@@ -691,6 +1053,10 @@ func includesName(names []string, name string) bool {
 	return false
 }
 
+func isValidLogFormat(format string) bool {
+	return format == "tsv" || format == "ltsv" || format == "json"
+}
+
 func cdFileDir(fileName string) {
 	os.Chdir(filepath.Dir(fileName))
 }
@@ -97,6 +97,7 @@ func (app *App) Start(service service.Service) error {
 	if err := app.proxy.InitPluginsGlobals(); err != nil {
 		dlog.Fatal(err)
 	}
+	app.reloadWatch()
 	go app.appMain()
 	return nil
 }
@@ -125,3 +126,20 @@ func (app *App) signalWatch() {
 		close(app.quit)
 	}()
 }
+
+func (app *App) reloadWatch() {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-reload:
+				dlog.Notice("Reload signal received...")
+				app.proxy.ReloadPlugins()
+			case <-app.quit:
+				signal.Stop(reload)
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,309 @@
+package dnscrypt
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+type adminAPIHandler struct {
+	proxy *Proxy
+	mux   *http.ServeMux
+}
+
+type adminAPIServer struct {
+	Name           string     `json:"name"`
+	Proto          string     `json:"proto"`
+	Address        string     `json:"address"`
+	Relay          string     `json:"relay,omitempty"`
+	RTT            float64    `json:"rtt_ms"`
+	InitialRTT     int        `json:"initial_rtt_ms"`
+	CertExpiration *time.Time `json:"cert_expiration,omitempty"`
+}
+
+type adminAPIPlugin struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	RulesFile   string `json:"rules_file,omitempty"`
+	Rules       *int   `json:"rules,omitempty"`
+}
+
+type adminAPICachedResponse struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Rcode   string   `json:"rcode"`
+	TTL     int64    `json:"ttl"`
+	Answers []string `json:"answers"`
+}
+
+// startAdminAPI serves the admin API on loopback addresses and unix sockets
+func (proxy *Proxy) startAdminAPI() error {
+	if len(proxy.AdminAPIListenAddresses) == 0 {
+		return nil
+	}
+	var listeners []net.Listener
+	closeListeners := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	for _, listenAddrStr := range proxy.AdminAPIListenAddresses {
+		listener, err := adminAPIListen(listenAddrStr)
+		if err != nil {
+			closeListeners()
+			return fmt.Errorf("Unable to start the admin API: [%s]", err)
+		}
+		listeners = append(listeners, listener)
+	}
+	handler := adminAPIHandler{proxy: proxy, mux: http.NewServeMux()}
+	handler.mux.HandleFunc("/servers", handler.servers)
+	handler.mux.HandleFunc("/servers/refresh", handler.refreshServers)
+	handler.mux.HandleFunc("/plugins", handler.plugins)
+	handler.mux.HandleFunc("/plugins/reload", handler.reloadPlugins)
+	handler.mux.HandleFunc("/cache", handler.cache)
+	handler.mux.HandleFunc("/cache/flush", handler.flushCache)
+	httpServer := &http.Server{
+		ReadTimeout: proxy.Timeout,
+		Handler:     handler,
+	}
+	if !proxy.addCloser(httpServer.Shutdown) {
+		closeListeners()
+		return nil
+	}
+	for _, listener := range listeners {
+		listener := listener
+		dlog.Noticef("Now listening to %v [admin API]", listener.Addr())
+		proxy.goBackground(func() {
+			if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+				dlog.Warnf("Admin API stopped: [%s]", err)
+			}
+		})
+	}
+	return nil
+}
+
+// adminAPIListen binds a unix socket if the address is an absolute path, or a TCP socket on a loopback address
+func adminAPIListen(listenAddrStr string) (net.Listener, error) {
+	if strings.HasPrefix(listenAddrStr, "/") {
+		if info, err := os.Lstat(listenAddrStr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(listenAddrStr)
+		}
+		listener, err := net.Listen("unix", listenAddrStr)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(listenAddrStr, 0600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	listenAddr, err := net.ResolveTCPAddr("tcp", listenAddrStr)
+	if err != nil {
+		return nil, err
+	}
+	if listenAddr.IP == nil || !listenAddr.IP.IsLoopback() {
+		return nil, fmt.Errorf("[%s] is not a loopback address", listenAddrStr)
+	}
+	return net.ListenTCP("tcp", listenAddr)
+}
+
+func (handler adminAPIHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Server", "dnscrypt-proxy")
+	authorization := request.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if len(token) == len(authorization) ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(handler.proxy.AdminAPIToken)) != 1 {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		adminAPIError(writer, http.StatusUnauthorized, errors.New("Invalid token"))
+		return
+	}
+	handler.mux.ServeHTTP(writer, request)
+}
+
+func adminAPIReply(writer http.ResponseWriter, status int, reply interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(reply)
+}
+
+func adminAPIError(writer http.ResponseWriter, status int, err error) {
+	adminAPIReply(writer, status, map[string]string{"error": err.Error()})
+}
+
+func adminAPIMethod(writer http.ResponseWriter, request *http.Request, method string) bool {
+	if request.Method == method {
+		return true
+	}
+	writer.Header().Set("Allow", method)
+	adminAPIError(writer, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed, use %s", method))
+	return false
+}
+
+func (handler adminAPIHandler) servers(writer http.ResponseWriter, request *http.Request) {
+	if !adminAPIMethod(writer, request, "GET") {
+		return
+	}
+	serversInfo := &handler.proxy.ServersInfo
+	serversInfo.RLock()
+	servers := make([]adminAPIServer, 0, len(serversInfo.inner))
+	for _, serverInfo := range serversInfo.inner {
+		server := adminAPIServer{
+			Name:       serverInfo.Name,
+			Proto:      StampProtoString(serverInfo.Proto),
+			InitialRTT: serverInfo.initialRtt,
+		}
+		if serverInfo.URL != nil {
+			server.Address = serverInfo.URL.String()
+		} else if serverInfo.TCPAddr != nil {
+			server.Address = serverInfo.TCPAddr.String()
+		}
+		if serverInfo.RelayUDPAddr != nil {
+			server.Relay = serverInfo.RelayUDPAddr.String()
+		} else if serverInfo.RelayURL != nil {
+			relayURL := *serverInfo.RelayURL
+			relayURL.RawQuery = ""
+			server.Relay = relayURL.String()
+		}
+		if serverInfo.rtt != nil {
+			server.RTT = serverInfo.rtt.Value()
+		}
+		if !serverInfo.certNotAfter.IsZero() {
+			certNotAfter := serverInfo.certNotAfter
+			server.CertExpiration = &certNotAfter
+		}
+		servers = append(servers, server)
+	}
+	serversInfo.RUnlock()
+	adminAPIReply(writer, http.StatusOK, map[string]interface{}{
+		"servers": servers,
+	})
+}
+
+func (handler adminAPIHandler) refreshServers(writer http.ResponseWriter, request *http.Request) {
+	if !adminAPIMethod(writer, request, "POST") {
+		return
+	}
+	dlog.Notice("Refreshing certificates on behalf of the admin API")
+	liveServers, err := handler.proxy.ServersInfo.refresh(handler.proxy)
+	reply := map[string]interface{}{
+		"live_servers": liveServers,
+	}
+	if err != nil {
+		reply["error"] = err.Error()
+	}
+	adminAPIReply(writer, http.StatusOK, reply)
+}
+
+func (handler adminAPIHandler) plugins(writer http.ResponseWriter, request *http.Request) {
+	if !adminAPIMethod(writer, request, "GET") {
+		return
+	}
+	pluginsGlobals := &handler.proxy.pluginsGlobals
+	pluginsGlobals.RLock()
+	pluginsLists := []struct {
+		pluginType string
+		plugins    *[]Plugin
+	}{
+		{"query", pluginsGlobals.queryPlugins},
+		{"response", pluginsGlobals.responsePlugins},
+		{"logging", pluginsGlobals.loggingPlugins},
+	}
+	pluginsGlobals.RUnlock()
+	plugins := []adminAPIPlugin{}
+	for _, pluginsList := range pluginsLists {
+		if pluginsList.plugins == nil {
+			continue
+		}
+		for _, plugin := range *pluginsList.plugins {
+			adminPlugin := adminAPIPlugin{
+				Name:        plugin.Name(),
+				Description: plugin.Description(),
+				Type:        pluginsList.pluginType,
+			}
+			if rulesFilePlugin, ok := plugin.(rulesFilePlugin); ok {
+				rules := rulesFilePlugin.loadedRulesCount()
+				adminPlugin.RulesFile = rulesFilePlugin.rulesFile()
+				adminPlugin.Rules = &rules
+			}
+			plugins = append(plugins, adminPlugin)
+		}
+	}
+	adminAPIReply(writer, http.StatusOK, map[string]interface{}{
+		"plugins": plugins,
+	})
+}
+
+func (handler adminAPIHandler) reloadPlugins(writer http.ResponseWriter, request *http.Request) {
+	if !adminAPIMethod(writer, request, "POST") {
+		return
+	}
+	dlog.Notice("Reloading the rules on behalf of the admin API")
+	if err := handler.proxy.ReloadPlugins(); err != nil {
+		adminAPIError(writer, http.StatusUnprocessableEntity, err)
+		return
+	}
+	adminAPIReply(writer, http.StatusOK, map[string]interface{}{
+		"reloaded": true,
+	})
+}
+
+func (handler adminAPIHandler) cache(writer http.ResponseWriter, request *http.Request) {
+	if !adminAPIMethod(writer, request, "GET") {
+		return
+	}
+	name := request.URL.Query().Get("name")
+	if len(name) > 0 {
+		name = dns.Fqdn(strings.ToLower(name))
+	}
+	now := time.Now()
+	responses := []adminAPICachedResponse{}
+	cachedResponses.forEach(func(key [32]byte, cached *CachedResponse) {
+		var msg dns.Msg
+		if err := msg.Unpack(cached.packet); err != nil || len(msg.Question) != 1 {
+			return
+		}
+		question := msg.Question[0]
+		if len(name) > 0 && strings.ToLower(question.Name) != name {
+			return
+		}
+		response := adminAPICachedResponse{
+			Name:    question.Name,
+			Type:    dns.TypeToString[question.Qtype],
+			Rcode:   dns.RcodeToString[msg.Rcode],
+			TTL:     int64(cached.expiration.Sub(now) / time.Second),
+			Answers: []string{},
+		}
+		for _, answer := range msg.Answer {
+			response.Answers = append(response.Answers, answer.String())
+		}
+		responses = append(responses, response)
+	})
+	adminAPIReply(writer, http.StatusOK, map[string]interface{}{
+		"entries":   len(responses),
+		"responses": responses,
+	})
+}
+
+func (handler adminAPIHandler) flushCache(writer http.ResponseWriter, request *http.Request) {
+	if !adminAPIMethod(writer, request, "POST") {
+		return
+	}
+	flushed := cachedResponses.purge()
+	dlog.Noticef("Cache flushed on behalf of the admin API (%d entries)", flushed)
+	adminAPIReply(writer, http.StatusOK, map[string]interface{}{
+		"flushed": flushed,
+	})
+}
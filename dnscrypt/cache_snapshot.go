@@ -0,0 +1,178 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultCacheSnapshotInterval = 10 * time.Minute
+	cacheSnapshotMagic           = "DCPC"
+	cacheSnapshotVersion         = 1
+)
+
+// A cache snapshot is made of a header (magic, version, number of entries),
+// the entries (expiration in nanoseconds since the epoch, cache key, length of the response, response),
+// and a SHA-256 hash of everything that precedes it.
+
+type cacheSnapshotEntry struct {
+	key      [32]byte
+	response *CachedResponse
+}
+
+// startCacheSnapshots loads the cache from the snapshot file, and saves it periodically as well as on shutdown
+func (proxy *Proxy) startCacheSnapshots() {
+	if !proxy.Cache || len(proxy.CacheSnapshotFile) == 0 {
+		return
+	}
+	count, err := loadCacheSnapshot(proxy.CacheSnapshotFile, proxy.CacheSize, proxy.ClientGroups)
+	if err != nil {
+		dlog.Warnf("Unable to load the cache from [%s]: [%s]", proxy.CacheSnapshotFile, err)
+	} else if count > 0 {
+		dlog.Noticef("%d cached responses loaded from [%s]", count, proxy.CacheSnapshotFile)
+	}
+	interval := proxy.CacheSnapshotInterval
+	if interval <= 0 {
+		interval = DefaultCacheSnapshotInterval
+	}
+	proxy.goBackground(func() {
+		for proxy.sleep(interval) {
+			proxy.saveCacheSnapshot()
+		}
+		proxy.saveCacheSnapshot()
+	})
+}
+
+func (proxy *Proxy) saveCacheSnapshot() {
+	count, err := saveCacheSnapshot(proxy.CacheSnapshotFile)
+	if err != nil {
+		dlog.Warnf("Unable to save the cache to [%s]: [%s]", proxy.CacheSnapshotFile, err)
+		return
+	}
+	dlog.Debugf("%d cached responses saved to [%s]", count, proxy.CacheSnapshotFile)
+}
+
+func saveCacheSnapshot(fileName string) (int, error) {
+	now := time.Now()
+	var entries []cacheSnapshotEntry
+	cachedResponses.forEach(func(key [32]byte, cached *CachedResponse) {
+		if now.After(cached.expiration) {
+			return
+		}
+		entries = append(entries, cacheSnapshotEntry{key: key, response: cached})
+	})
+
+	var snapshot bytes.Buffer
+	snapshot.WriteString(cacheSnapshotMagic)
+	snapshot.WriteByte(cacheSnapshotVersion)
+	count := 0
+	var body bytes.Buffer
+	for _, entry := range entries {
+		packet := entry.response.packet
+		var header [8 + 32 + 2]byte
+		binary.BigEndian.PutUint64(header[0:8], uint64(entry.response.expiration.UnixNano()))
+		copy(header[8:40], entry.key[:])
+		binary.BigEndian.PutUint16(header[40:42], uint16(len(packet)))
+		body.Write(header[:])
+		body.Write(packet)
+		count++
+	}
+	var countBin [4]byte
+	binary.BigEndian.PutUint32(countBin[:], uint32(count))
+	snapshot.Write(countBin[:])
+	snapshot.Write(body.Bytes())
+	hash := sha256.Sum256(snapshot.Bytes())
+	snapshot.Write(hash[:])
+	return count, AtomicFileWrite(fileName, snapshot.Bytes())
+}
+
+func loadCacheSnapshot(fileName string, cacheSize int, clientGroups []*ClientGroup) (int, error) {
+	snapshot, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	headerLen := len(cacheSnapshotMagic) + 1 + 4
+	if len(snapshot) < headerLen+sha256.Size {
+		return 0, errors.New("Truncated file")
+	}
+	content, hash := snapshot[:len(snapshot)-sha256.Size], snapshot[len(snapshot)-sha256.Size:]
+	if computedHash := sha256.Sum256(content); !bytes.Equal(computedHash[:], hash) {
+		return 0, errors.New("Checksum mismatch")
+	}
+	if string(content[:len(cacheSnapshotMagic)]) != cacheSnapshotMagic {
+		return 0, errors.New("Not a cache snapshot")
+	}
+	if version := content[len(cacheSnapshotMagic)]; version != cacheSnapshotVersion {
+		return 0, errors.New("Unsupported snapshot version")
+	}
+	count := binary.BigEndian.Uint32(content[headerLen-4 : headerLen])
+	content = content[headerLen:]
+	now := time.Now()
+	var entries []cacheSnapshotEntry
+	for i := uint32(0); i < count; i++ {
+		if len(content) < 8+32+2 {
+			return 0, errors.New("Truncated entry")
+		}
+		expiration := time.Unix(0, int64(binary.BigEndian.Uint64(content[0:8])))
+		var key [32]byte
+		copy(key[:], content[8:40])
+		packetLen := int(binary.BigEndian.Uint16(content[40:42]))
+		content = content[42:]
+		if len(content) < packetLen {
+			return 0, errors.New("Truncated entry")
+		}
+		packet := content[:packetLen]
+		content = content[packetLen:]
+		if now.After(expiration) {
+			continue
+		}
+		var msg dns.Msg
+		if err := msg.Unpack(packet); err != nil {
+			return 0, err
+		}
+		if !cacheSnapshotKeyMatches(key, &msg, clientGroups) {
+			// The response was cached for a client group that doesn't exist any more
+			continue
+		}
+		response, err := newCachedResponse(packet, expiration, time.Time{})
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, cacheSnapshotEntry{key: key, response: response})
+	}
+	if len(content) != 0 {
+		return 0, errors.New("Trailing data")
+	}
+	cachedResponses.init(cacheSize)
+	for _, entry := range entries {
+		cachedResponses.add(entry.key, entry.response)
+	}
+	return len(entries), nil
+}
+
+// cacheSnapshotKeyMatches checks that a cache key was computed from the question of the response,
+// for clients outside any group or for one of the client groups
+func cacheSnapshotKeyMatches(key [32]byte, msg *dns.Msg, clientGroups []*ClientGroup) bool {
+	for _, clientGroup := range append([]*ClientGroup{nil}, clientGroups...) {
+		for _, dnssec := range []bool{false, true} {
+			computedKey, err := computeCacheKey(&PluginsState{dnssec: dnssec, clientGroup: clientGroup}, msg)
+			if err != nil {
+				return false
+			}
+			if computedKey == key {
+				return true
+			}
+		}
+	}
+	return false
+}
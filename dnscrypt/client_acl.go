@@ -0,0 +1,103 @@
+package dnscrypt
+
+import (
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	DeniedClientActionDrop    = "drop"
+	DeniedClientActionRefused = "refused"
+)
+
+// ClientACL restricts the clients allowed to send queries to a listener.
+// Denied networks take precedence. If allowed networks are given, clients outside of them are denied.
+type ClientACL struct {
+	Allowed []*net.IPNet
+	Denied  []*net.IPNet
+}
+
+// allows tells whether a client can send queries; a nil ACL allows everyone
+func (acl *ClientACL) allows(clientAddr net.Addr) bool {
+	if acl == nil {
+		return true
+	}
+	clientIP := addrIP(&clientAddr)
+	if clientIP == nil {
+		return false
+	}
+	for _, network := range acl.Denied {
+		if network.Contains(clientIP) {
+			return false
+		}
+	}
+	if len(acl.Allowed) == 0 {
+		return true
+	}
+	for _, network := range acl.Allowed {
+		if network.Contains(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerClientACL returns the ACL of the listener bound to localAddr, or the global ACL if it doesn't have its own
+func (proxy *Proxy) listenerClientACL(localAddr net.Addr) *ClientACL {
+	localIP, localPort := addrIPPort(localAddr)
+	for listenAddrStr, acl := range proxy.ListenerClientACLs {
+		if listenAddrStr == localAddr.String() {
+			return acl
+		}
+		listenAddr, err := net.ResolveTCPAddr("tcp", listenAddrStr)
+		if err == nil && listenAddr.Port == localPort && listenAddr.IP.Equal(localIP) {
+			return acl
+		}
+	}
+	return proxy.ClientACL
+}
+
+// noticeDeniedClient counts and logs a query from a client that isn't allowed to use a listener
+func (proxy *Proxy) noticeDeniedClient(clientAddr net.Addr, localAddr net.Addr) {
+	dlog.Infof("Client [%v] denied on [%v]", clientAddr, localAddr)
+	proxy.metrics.countDeniedClient(localAddr.String())
+}
+
+// denyStreamClient closes a connection from a client that isn't allowed to use a listener,
+// after answering its first query with REFUSED if that is the action for denied clients
+func (proxy *Proxy) denyStreamClient(clientPc net.Conn, localAddr net.Addr) {
+	proxy.noticeDeniedClient(clientPc.RemoteAddr(), localAddr)
+	if proxy.DeniedClientAction != DeniedClientActionRefused {
+		clientPc.Close()
+		return
+	}
+	proxy.inFlight.Add(1)
+	go func() {
+		defer proxy.inFlight.Done()
+		proxy.refuseStreamClient(clientPc)
+	}()
+}
+
+// refuseStreamClient answers the first query of a denied TCP client with REFUSED, and closes the connection
+func (proxy *Proxy) refuseStreamClient(clientPc net.Conn) {
+	defer clientPc.Close()
+	if !proxy.addClientConn(clientPc) {
+		return
+	}
+	defer proxy.removeClientConn(clientPc)
+	clientPc.SetDeadline(time.Now().Add(TCPIdleTimeout))
+	query, err := ReadPrefixed(&clientPc)
+	if err != nil {
+		return
+	}
+	response := minimalResponse(query, dns.RcodeRefused, false)
+	if response == nil {
+		return
+	}
+	if prefixedResponse, err := PrefixWithSize(response); err == nil {
+		clientPc.Write(prefixedResponse)
+	}
+}
@@ -0,0 +1,177 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// ClientIDEDNSOption is the EDNS option carrying a client identifier, as added by dnsmasq's `add-cpe-id`
+const ClientIDEDNSOption = 65074
+
+// ClientGroup is a set of clients using their own rules instead of the global ones.
+// Clients are identified by their address, or by a client ID sent as an EDNS option.
+type ClientGroup struct {
+	Name                 string
+	Networks             []*net.IPNet
+	ClientIDs            []string
+	BlockNameFile        string
+	WhitelistNameFile    string
+	CloakFile            string
+	BlockedQueryResponse string
+	AllWeeklyRanges      *map[string]WeeklyRanges
+	RateLimit            *RateLimit
+	blockedResponse      blockedResponse
+}
+
+// blockedResponse describes the response to a blocked query
+type blockedResponse struct {
+	refusedCode bool
+	ipv4        net.IP
+	ipv6        net.IP
+}
+
+// findClientGroup returns the group of a client, or nil if the global rules apply.
+// A client ID takes precedence over the address, which is matched against the most specific network.
+// Client IDs are only accepted from hosts in clientIDNetworks.
+func findClientGroup(clientGroups []*ClientGroup, clientIDNetworks []*net.IPNet, clientAddr *net.Addr, msg *dns.Msg) *ClientGroup {
+	if len(clientGroups) == 0 {
+		return nil
+	}
+	clientIP := addrIP(clientAddr)
+	if clientID := ednsClientID(msg); len(clientID) > 0 && clientIP != nil && networksContain(clientIDNetworks, clientIP) {
+		for _, clientGroup := range clientGroups {
+			for _, groupClientID := range clientGroup.ClientIDs {
+				if groupClientID == string(clientID) {
+					return clientGroup
+				}
+			}
+		}
+	}
+	return findClientGroupByIP(clientGroups, clientIP)
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// findClientGroupByIP returns the group whose most specific network contains the address of a client
+func findClientGroupByIP(clientGroups []*ClientGroup, clientIP net.IP) *ClientGroup {
+	if clientIP == nil {
+		return nil
+	}
+	var found *ClientGroup
+	foundPrefixLen := -1
+	for _, clientGroup := range clientGroups {
+		for _, network := range clientGroup.Networks {
+			if prefixLen, _ := network.Mask.Size(); prefixLen > foundPrefixLen && network.Contains(clientIP) {
+				found, foundPrefixLen = clientGroup, prefixLen
+			}
+		}
+	}
+	return found
+}
+
+func ednsClientID(msg *dns.Msg) []byte {
+	edns0 := msg.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+	for _, option := range edns0.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == ClientIDEDNSOption {
+			return bytes.TrimSpace(local.Data)
+		}
+	}
+	return nil
+}
+
+// removeEDNSClientID removes the client ID from a query, so that it is not sent to the servers
+func removeEDNSClientID(msg *dns.Msg) {
+	edns0 := msg.IsEdns0()
+	if edns0 == nil {
+		return
+	}
+	options := edns0.Option[:0]
+	for _, option := range edns0.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); !ok || local.Code != ClientIDEDNSOption {
+			options = append(options, option)
+		}
+	}
+	edns0.Option = options
+}
+
+func addrIP(addr *net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	switch addr := (*addr).(type) {
+	case *net.UDPAddr:
+		if addr != nil {
+			return addr.IP
+		}
+	case *net.TCPAddr:
+		if addr != nil {
+			return addr.IP
+		}
+	}
+	return nil
+}
+
+// hasClientGroupsFile tells whether at least one client group has a rules file for a plugin
+func (proxy *Proxy) hasClientGroupsFile(groupFile func(clientGroup *ClientGroup) string) bool {
+	for _, clientGroup := range proxy.ClientGroups {
+		if len(groupFile(clientGroup)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// clientGroupsFiles returns the rules files of the client groups for a plugin
+func (proxy *Proxy) clientGroupsFiles(groupFile func(clientGroup *ClientGroup) string) []string {
+	var fileNames []string
+	for _, clientGroup := range proxy.ClientGroups {
+		if fileName := groupFile(clientGroup); len(fileName) > 0 {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	return fileNames
+}
+
+// loadClientGroupsRules loads the rules of the client groups having a file for a plugin.
+// A file only made of invalid rules causes an error, so that the previous rules can be kept when reloading.
+func (proxy *Proxy) loadClientGroupsRules(rulesType string, groupFile func(clientGroup *ClientGroup) string,
+	load func(clientGroup *ClientGroup, fileName string) (*PatternMatcher, rulesCount, error)) (map[string]*PatternMatcher, error) {
+	patternMatchers := make(map[string]*PatternMatcher)
+	for _, clientGroup := range proxy.ClientGroups {
+		fileName := groupFile(clientGroup)
+		if len(fileName) == 0 {
+			continue
+		}
+		dlog.Noticef("Loading the set of %s of the [%s] client group from [%s]", rulesType, clientGroup.Name, fileName)
+		patternMatcher, count, err := load(clientGroup, fileName)
+		if err != nil {
+			return nil, err
+		}
+		if err := count.check(fileName); err != nil {
+			return nil, err
+		}
+		patternMatchers[clientGroup.Name] = patternMatcher
+	}
+	return patternMatchers, nil
+}
+
+// clientPatternMatcher returns the rules of the group of the client if it belongs to one, and the global rules otherwise
+func clientPatternMatcher(pluginsState *PluginsState, patternMatcher *PatternMatcher, groupPatternMatchers map[string]*PatternMatcher) *PatternMatcher {
+	if clientGroup := pluginsState.clientGroup; clientGroup != nil {
+		return groupPatternMatchers[clientGroup.Name]
+	}
+	return patternMatcher
+}
@@ -3,7 +3,9 @@ package dnscrypt
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -54,28 +56,23 @@ func PrefixWithSize(packet []byte) ([]byte, error) {
 	return packet, nil
 }
 
+// ReadPrefixed reads exactly one message, leaving pipelined messages untouched
 func ReadPrefixed(conn *net.Conn) ([]byte, error) {
 	buf := make([]byte, 2+MaxDNSPacketSize)
-	packetLength, pos := -1, 0
-	for {
-		readnb, err := (*conn).Read(buf[pos:])
-		if err != nil {
-			return buf, err
-		}
-		pos += readnb
-		if pos >= 2 && packetLength < 0 {
-			packetLength = int(binary.BigEndian.Uint16(buf[0:2]))
-			if packetLength > MaxDNSPacketSize-1 {
-				return buf, errors.New("Packet too large")
-			}
-			if packetLength < MinDNSPacketSize {
-				return buf, errors.New("Packet too short")
-			}
-		}
-		if packetLength >= 0 && pos >= 2+packetLength {
-			return buf[2 : 2+packetLength], nil
-		}
+	if _, err := io.ReadFull(*conn, buf[:2]); err != nil {
+		return buf, err
+	}
+	packetLength := int(binary.BigEndian.Uint16(buf[0:2]))
+	if packetLength > MaxDNSPacketSize-1 {
+		return buf, errors.New("Packet too large")
 	}
+	if packetLength < MinDNSPacketSize {
+		return buf, errors.New("Packet too short")
+	}
+	if _, err := io.ReadFull(*conn, buf[2:2+packetLength]); err != nil {
+		return buf, err
+	}
+	return buf[2 : 2+packetLength], nil
 }
 
 func Min(a, b int) int {
@@ -161,3 +158,26 @@ func ReadTextFile(filename string) (string, error) {
 	bin = bytes.TrimPrefix(bin, []byte{0xef, 0xbb, 0xbf})
 	return string(bin), nil
 }
+
+// jsonLogLine encodes a log entry as a single line of JSON
+func jsonLogLine(entry interface{}) (string, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	return string(line) + "\n", nil
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		if addr != nil {
+			return addr.IP, addr.Port
+		}
+	case *net.TCPAddr:
+		if addr != nil {
+			return addr.IP, addr.Port
+		}
+	}
+	return nil, 0
+}
@@ -0,0 +1,293 @@
+package dnscrypt
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	UDPPoolIdleTimeout  = 30 * time.Second
+	TCPPoolIdleTimeout  = 10 * time.Second
+	TCPPoolMaxIdleConns = 4
+)
+
+var errConnPoolClosed = errors.New("Connection pool closed")
+
+// ConnPool keeps the connections to a DNSCrypt server, or to the relay used to
+// reach it, open across queries.
+// A single UDP socket is shared by all the queries, and responses are matched using their nonce.
+// TCP connections are reused for sequential queries.
+type ConnPool struct {
+	sync.Mutex
+	proxy    *Proxy
+	name     string
+	udpAddr  *net.UDPAddr
+	tcpAddr  *net.TCPAddr
+	udpConn  *udpPoolConn
+	tcpConns []tcpPoolConn
+	closed   bool
+}
+
+type udpPoolConn struct {
+	sync.Mutex
+	conn    *net.UDPConn
+	pending map[[HalfNonceSize]byte]chan []byte
+	err     error
+}
+
+type tcpPoolConn struct {
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+func NewConnPool(proxy *Proxy, name string, udpAddr *net.UDPAddr, tcpAddr *net.TCPAddr) *ConnPool {
+	return &ConnPool{
+		proxy:   proxy,
+		name:    name,
+		udpAddr: udpAddr,
+		tcpAddr: tcpAddr,
+	}
+}
+
+func (pool *ConnPool) getUDPConn() (*udpPoolConn, error) {
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.closed {
+		return nil, errConnPoolClosed
+	}
+	if pool.udpConn != nil {
+		return pool.udpConn, nil
+	}
+	pc, err := net.DialUDP("udp", nil, pool.udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &udpPoolConn{
+		conn:    pc,
+		pending: make(map[[HalfNonceSize]byte]chan []byte),
+	}
+	pool.udpConn = conn
+	go pool.udpReader(conn)
+	return conn, nil
+}
+
+func (pool *ConnPool) udpReader(conn *udpPoolConn) {
+	buffer := make([]byte, MaxDNSPacketSize)
+	for {
+		conn.conn.SetReadDeadline(time.Now().Add(UDPPoolIdleTimeout))
+		length, err := conn.conn.Read(buffer)
+		if err != nil {
+			conn.Lock()
+			idle := len(conn.pending) == 0
+			conn.Unlock()
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() && !idle {
+				continue
+			}
+			pool.failUDP(conn, err)
+			return
+		}
+		nonceOffset := len(ServerMagic)
+		if length < nonceOffset+HalfNonceSize {
+			continue
+		}
+		var clientNonce [HalfNonceSize]byte
+		copy(clientNonce[:], buffer[nonceOffset:nonceOffset+HalfNonceSize])
+		conn.Lock()
+		responseChan, ok := conn.pending[clientNonce]
+		if ok {
+			delete(conn.pending, clientNonce)
+		}
+		conn.Unlock()
+		if !ok {
+			dlog.Debugf("[%s] Unexpected UDP response", pool.name)
+			continue
+		}
+		responseChan <- append([]byte{}, buffer[:length]...)
+		pool.closeUDPIfDrained(conn)
+	}
+}
+
+func (pool *ConnPool) failUDP(conn *udpPoolConn, err error) {
+	pool.Lock()
+	if pool.udpConn == conn {
+		pool.udpConn = nil
+	}
+	pool.Unlock()
+	conn.Lock()
+	if conn.err == nil {
+		conn.err = err
+	}
+	for clientNonce, responseChan := range conn.pending {
+		close(responseChan)
+		delete(conn.pending, clientNonce)
+	}
+	conn.Unlock()
+	conn.conn.Close()
+}
+
+func (pool *ConnPool) closeUDPIfDrained(conn *udpPoolConn) {
+	pool.Lock()
+	closed := pool.closed
+	pool.Unlock()
+	if !closed {
+		return
+	}
+	conn.Lock()
+	drained := len(conn.pending) == 0
+	conn.Unlock()
+	if drained {
+		pool.failUDP(conn, errConnPoolClosed)
+	}
+}
+
+// ExchangeUDP sends an encrypted query over the shared UDP socket, and waits for the response with the same client nonce
+func (pool *ConnPool) ExchangeUDP(encryptedQuery []byte, clientNonce []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := pool.getUDPConn()
+	if err != nil {
+		return nil, err
+	}
+	var key [HalfNonceSize]byte
+	copy(key[:], clientNonce)
+	responseChan := make(chan []byte, 1)
+	conn.Lock()
+	if conn.err != nil {
+		err = conn.err
+	} else if _, inUse := conn.pending[key]; inUse {
+		err = errors.New("Duplicate nonce")
+	} else {
+		conn.pending[key] = responseChan
+	}
+	conn.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.conn.Write(encryptedQuery); err != nil {
+		pool.forgetUDP(conn, key)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-responseChan:
+		if !ok {
+			conn.Lock()
+			err := conn.err
+			conn.Unlock()
+			if err == nil {
+				err = errConnPoolClosed
+			}
+			return nil, err
+		}
+		return response, nil
+	case <-timer.C:
+		pool.forgetUDP(conn, key)
+		return nil, poolTimeoutError{}
+	}
+}
+
+func (pool *ConnPool) forgetUDP(conn *udpPoolConn, key [HalfNonceSize]byte) {
+	conn.Lock()
+	delete(conn.pending, key)
+	conn.Unlock()
+	pool.closeUDPIfDrained(conn)
+}
+
+func (pool *ConnPool) dialTCP(timeout time.Duration) (net.Conn, error) {
+	proxyDialer := pool.proxy.XTransport.ProxyDialer
+	if proxyDialer == nil {
+		return net.DialTimeout("tcp", pool.tcpAddr.String(), timeout)
+	}
+	return dialWithTimeout(*proxyDialer, "tcp", pool.tcpAddr.String(), timeout)
+}
+
+func (pool *ConnPool) getIdleTCPConn() net.Conn {
+	pool.Lock()
+	defer pool.Unlock()
+	for len(pool.tcpConns) > 0 {
+		last := len(pool.tcpConns) - 1
+		tcpConn := pool.tcpConns[last]
+		pool.tcpConns = pool.tcpConns[:last]
+		if time.Since(tcpConn.lastUsed) < TCPPoolIdleTimeout {
+			return tcpConn.conn
+		}
+		tcpConn.conn.Close()
+	}
+	return nil
+}
+
+func (pool *ConnPool) putIdleTCPConn(conn net.Conn) {
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.closed || len(pool.tcpConns) >= TCPPoolMaxIdleConns {
+		conn.Close()
+		return
+	}
+	pool.tcpConns = append(pool.tcpConns, tcpPoolConn{conn: conn, lastUsed: time.Now()})
+}
+
+// ExchangeTCP sends a prefixed, encrypted query over a TCP connection, reusing an idle connection if possible
+func (pool *ConnPool) ExchangeTCP(prefixedQuery []byte, timeout time.Duration) ([]byte, error) {
+	pool.Lock()
+	closed := pool.closed
+	pool.Unlock()
+	if closed {
+		return nil, errConnPoolClosed
+	}
+	// An idle connection may have been closed by the server in the meantime,
+	// so a failure on a reused connection is retried once on a new connection
+	if conn := pool.getIdleTCPConn(); conn != nil {
+		if response, err := pool.exchangeTCP(conn, prefixedQuery, timeout); err == nil {
+			return response, nil
+		} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			return nil, err
+		}
+		dlog.Debugf("[%s] Reused TCP connection failed, retrying on a new connection", pool.name)
+	}
+	conn, err := pool.dialTCP(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return pool.exchangeTCP(conn, prefixedQuery, timeout)
+}
+
+func (pool *ConnPool) exchangeTCP(conn net.Conn, prefixedQuery []byte, timeout time.Duration) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(prefixedQuery); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response, err := ReadPrefixed(&conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	pool.putIdleTCPConn(conn)
+	return response, nil
+}
+
+// Close closes idle connections, and the shared UDP socket as soon as pending queries have been answered
+func (pool *ConnPool) Close() {
+	pool.Lock()
+	pool.closed = true
+	tcpConns := pool.tcpConns
+	pool.tcpConns = nil
+	udpConn := pool.udpConn
+	pool.Unlock()
+	for _, tcpConn := range tcpConns {
+		tcpConn.conn.Close()
+	}
+	if udpConn != nil {
+		pool.closeUDPIfDrained(udpConn)
+	}
+}
+
+type poolTimeoutError struct{}
+
+func (poolTimeoutError) Error() string   { return "Query timeout" }
+func (poolTimeoutError) Timeout() bool   { return true }
+func (poolTimeoutError) Temporary() bool { return true }
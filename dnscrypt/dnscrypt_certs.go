@@ -19,6 +19,7 @@ type CertInfo struct {
 	MagicQuery         [ClientMagicLen]byte
 	CryptoConstruction CryptoConstruction
 	ForwardSecurity    bool
+	NotAfter           time.Time
 }
 
 func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk ed25519.PublicKey, serverAddress string, providerName string, isNew bool, relayUDPAddr *net.UDPAddr, relayTCPAddr *net.TCPAddr) (CertInfo, int, error) {
@@ -31,6 +32,10 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 	if serverName == nil {
 		serverName = &providerName
 	}
+	// CertIgnoreTimestamp is reset by the refresh of the servers, under the lock of the servers list
+	proxy.ServersInfo.RLock()
+	certIgnoreTimestamp := proxy.CertIgnoreTimestamp
+	proxy.ServersInfo.RUnlock()
 	query := new(dns.Msg)
 	query.SetQuestion(providerName, dns.TypeTXT)
 	if !strings.HasPrefix(providerName, "2.dnscrypt-cert.") {
@@ -105,7 +110,7 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 		} else {
 			certInfo.ForwardSecurity = true
 		}
-		if !proxy.CertIgnoreTimestamp {
+		if !certIgnoreTimestamp {
 			if now > tsEnd || now < tsBegin {
 				dlog.Debugf("[%v] Certificate not valid at the current date (now: %v is not in [%v..%v])", providerName, now, tsBegin, tsEnd)
 				continue
@@ -135,6 +140,7 @@ func FetchCurrentDNSCryptCert(proxy *Proxy, serverName *string, proto string, pk
 		certInfo.CryptoConstruction = cryptoConstruction
 		copy(certInfo.ServerPk[:], serverPk[:])
 		copy(certInfo.MagicQuery[:], binCert[104:112])
+		certInfo.NotAfter = time.Unix(int64(tsEnd), 0)
 		if isNew {
 			dlog.Noticef("[%s] OK (DNSCrypt) - rtt: %dms%s", *serverName, rtt.Nanoseconds()/1000000, certCountStr)
 		} else {
@@ -0,0 +1,333 @@
+package dnscrypt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	DnstapQueueSize      = 1024
+	DnstapReconnectDelay = 5 * time.Second
+	dnstapContentType    = "protobuf:dnstap.Dnstap"
+)
+
+// Frame Streams control frames and fields
+const (
+	fstrmControlAccept    = 0x01
+	fstrmControlStart     = 0x02
+	fstrmControlStop      = 0x03
+	fstrmControlReady     = 0x04
+	fstrmFieldContentType = 0x01
+	fstrmMaxControlSize   = 512
+)
+
+// dnstap message types
+const (
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// dnstap socket families and protocols
+const (
+	dnstapFamilyINET          = 1
+	dnstapFamilyINET6         = 2
+	dnstapProtocolUDP         = 1
+	dnstapProtocolTCP         = 2
+	dnstapProtocolDoT         = 3
+	dnstapProtocolDoH         = 4
+	dnstapProtocolDNSCryptUDP = 5
+	dnstapProtocolDNSCryptTCP = 6
+)
+
+type dnstapMessage struct {
+	messageType     uint64
+	socketProtocol  uint64
+	queryAddr       net.Addr
+	responseAddr    net.Addr
+	queryTime       time.Time
+	queryMessage    []byte
+	responseTime    time.Time
+	responseMessage []byte
+}
+
+type protobufEncoder struct {
+	buf []byte
+}
+
+func (encoder *protobufEncoder) uvarint(x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	encoder.buf = append(encoder.buf, tmp[:n]...)
+}
+
+func (encoder *protobufEncoder) varintField(field int, x uint64) {
+	encoder.uvarint(uint64(field) << 3)
+	encoder.uvarint(x)
+}
+
+func (encoder *protobufEncoder) bytesField(field int, bin []byte) {
+	encoder.uvarint(uint64(field)<<3 | 2)
+	encoder.uvarint(uint64(len(bin)))
+	encoder.buf = append(encoder.buf, bin...)
+}
+
+func (encoder *protobufEncoder) fixed32Field(field int, x uint32) {
+	encoder.uvarint(uint64(field)<<3 | 5)
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], x)
+	encoder.buf = append(encoder.buf, tmp[:]...)
+}
+
+// encodeDnstapFrame encodes a dnstap message as a Frame Streams data frame
+func encodeDnstapFrame(identity []byte, version []byte, message *dnstapMessage) []byte {
+	msg := protobufEncoder{}
+	msg.varintField(1, message.messageType)
+	queryIP, queryPort := addrIPPort(message.queryAddr)
+	responseIP, responsePort := addrIPPort(message.responseAddr)
+	familyIP := queryIP
+	if familyIP == nil {
+		familyIP = responseIP
+	}
+	if familyIP != nil {
+		if familyIP.To4() != nil {
+			msg.varintField(2, dnstapFamilyINET)
+		} else {
+			msg.varintField(2, dnstapFamilyINET6)
+		}
+	}
+	if message.socketProtocol != 0 {
+		msg.varintField(3, message.socketProtocol)
+	}
+	for _, address := range []struct {
+		ip        net.IP
+		port      int
+		ipField   int
+		portField int
+	}{{queryIP, queryPort, 4, 6}, {responseIP, responsePort, 5, 7}} {
+		if address.ip == nil {
+			continue
+		}
+		if ipv4 := address.ip.To4(); ipv4 != nil {
+			msg.bytesField(address.ipField, ipv4)
+		} else {
+			msg.bytesField(address.ipField, address.ip.To16())
+		}
+		msg.varintField(address.portField, uint64(address.port))
+	}
+	if !message.queryTime.IsZero() {
+		msg.varintField(8, uint64(message.queryTime.Unix()))
+		msg.fixed32Field(9, uint32(message.queryTime.Nanosecond()))
+	}
+	if len(message.queryMessage) > 0 {
+		msg.bytesField(10, message.queryMessage)
+	}
+	if !message.responseTime.IsZero() {
+		msg.varintField(12, uint64(message.responseTime.Unix()))
+		msg.fixed32Field(13, uint32(message.responseTime.Nanosecond()))
+	}
+	if len(message.responseMessage) > 0 {
+		msg.bytesField(14, message.responseMessage)
+	}
+
+	frame := protobufEncoder{buf: make([]byte, 4, 4+len(msg.buf)+len(identity)+len(version)+16)}
+	if len(identity) > 0 {
+		frame.bytesField(1, identity)
+	}
+	if len(version) > 0 {
+		frame.bytesField(2, version)
+	}
+	frame.bytesField(14, msg.buf)
+	frame.varintField(15, 1) // MESSAGE
+	binary.BigEndian.PutUint32(frame.buf[0:4], uint32(len(frame.buf)-4))
+	return frame.buf
+}
+
+func fstrmControlFrame(controlType uint32, withContentType bool) []byte {
+	frame := make([]byte, 12, 12+8+len(dnstapContentType))
+	binary.BigEndian.PutUint32(frame[8:12], controlType)
+	if withContentType {
+		var field [8]byte
+		binary.BigEndian.PutUint32(field[0:4], fstrmFieldContentType)
+		binary.BigEndian.PutUint32(field[4:8], uint32(len(dnstapContentType)))
+		frame = append(frame, field[:]...)
+		frame = append(frame, dnstapContentType...)
+	}
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(frame)-8))
+	return frame
+}
+
+func fstrmReadControlFrame(reader io.Reader) (uint32, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != 0 {
+		return 0, errors.New("Unexpected data frame")
+	}
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length < 4 || length > fstrmMaxControlSize {
+		return 0, errors.New("Invalid control frame length")
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, int64(length-4)); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(header[8:12]), nil
+}
+
+// dnstapWriter sends Frame Streams data frames to a unix socket, a TCP endpoint or a file.
+// Frames are queued and dropped if the output can't keep up, so that queries are never slowed down.
+type dnstapWriter struct {
+	network   string
+	address   string
+	timeout   time.Duration
+	frames    chan []byte
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func newDnstapWriter(network string, address string, timeout time.Duration) *dnstapWriter {
+	writer := &dnstapWriter{
+		network: network,
+		address: address,
+		timeout: timeout,
+		frames:  make(chan []byte, DnstapQueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go writer.run()
+	return writer
+}
+
+func (writer *dnstapWriter) write(frame []byte) {
+	select {
+	case <-writer.done:
+		return
+	default:
+	}
+	select {
+	case writer.frames <- frame:
+	default:
+		dlog.Debug("dnstap queue full - Dropping a frame")
+	}
+}
+
+// Close flushes the queued frames and ends the stream
+func (writer *dnstapWriter) Close(ctx context.Context) error {
+	writer.closeOnce.Do(func() { close(writer.done) })
+	select {
+	case <-writer.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (writer *dnstapWriter) run() {
+	defer close(writer.stopped)
+	for {
+		output, bidirectional, err := writer.open()
+		if err == nil {
+			if writer.copyFrames(output, bidirectional) {
+				return
+			}
+		} else {
+			dlog.Warnf("Unable to open the dnstap output [%s]: [%s]", writer.address, err)
+		}
+		if writer.network == "file" {
+			<-writer.done
+			return
+		}
+		select {
+		case <-writer.done:
+			return
+		case <-time.After(DnstapReconnectDelay):
+		}
+	}
+}
+
+func (writer *dnstapWriter) open() (io.ReadWriteCloser, bool, error) {
+	if writer.network == "file" {
+		file, err := os.Create(writer.address)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err := file.Write(fstrmControlFrame(fstrmControlStart, true)); err != nil {
+			file.Close()
+			return nil, false, err
+		}
+		return file, false, nil
+	}
+	conn, err := net.DialTimeout(writer.network, writer.address, writer.timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	conn.SetDeadline(time.Now().Add(writer.timeout))
+	if _, err := conn.Write(fstrmControlFrame(fstrmControlReady, true)); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	controlType, err := fstrmReadControlFrame(conn)
+	if err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	if controlType != fstrmControlAccept {
+		conn.Close()
+		return nil, false, errors.New("The dnstap reader didn't accept the connection")
+	}
+	if _, err := conn.Write(fstrmControlFrame(fstrmControlStart, true)); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	conn.SetDeadline(time.Time{})
+	dlog.Noticef("Sending dnstap frames to [%s]", writer.address)
+	return conn, true, nil
+}
+
+// copyFrames writes the queued frames until the writer is closed, in which case true is returned,
+// or until the output fails
+func (writer *dnstapWriter) copyFrames(output io.ReadWriteCloser, bidirectional bool) bool {
+	defer output.Close()
+	buffered := bufio.NewWriter(output)
+	for {
+		select {
+		case frame := <-writer.frames:
+			if _, err := buffered.Write(frame); err != nil {
+				dlog.Warnf("Unable to write to the dnstap output [%s]: [%s]", writer.address, err)
+				return false
+			}
+			if len(writer.frames) == 0 {
+				if err := buffered.Flush(); err != nil {
+					dlog.Warnf("Unable to write to the dnstap output [%s]: [%s]", writer.address, err)
+					return false
+				}
+			}
+		case <-writer.done:
+			for len(writer.frames) > 0 {
+				buffered.Write(<-writer.frames)
+			}
+			buffered.Write(fstrmControlFrame(fstrmControlStop, false))
+			if err := buffered.Flush(); err != nil || !bidirectional {
+				return true
+			}
+			if conn, ok := output.(net.Conn); ok {
+				conn.SetReadDeadline(time.Now().Add(writer.timeout))
+			}
+			fstrmReadControlFrame(output)
+			return true
+		}
+	}
+}
@@ -2,6 +2,7 @@ package dnscrypt
 
 import (
 	"encoding/binary"
+	"errors"
 	"net"
 	"strings"
 	"time"
@@ -171,6 +172,10 @@ func updateTTL(msg *dns.Msg, expiration time.Time) {
 	if until > 0 {
 		ttl = uint32(until / time.Second)
 	}
+	setTTL(msg, ttl)
+}
+
+func setTTL(msg *dns.Msg, ttl uint32) {
 	for _, rr := range msg.Answer {
 		rr.Header().Ttl = ttl
 	}
@@ -183,3 +188,81 @@ func updateTTL(msg *dns.Msg, expiration time.Time) {
 		}
 	}
 }
+
+// packetTTLOffsets returns the offsets of the TTLs of all the records of a packet, except the OPT pseudo-record
+func packetTTLOffsets(packet []byte) ([]uint16, error) {
+	if len(packet) < 12 || len(packet) > MaxDNSPacketSize {
+		return nil, errors.New("Invalid packet length")
+	}
+	offset := 12
+	var err error
+	for i := binary.BigEndian.Uint16(packet[4:6]); i > 0; i-- {
+		if offset, err = skipPacketName(packet, offset); err != nil {
+			return nil, err
+		}
+		offset += 4
+	}
+	rrCount := int(binary.BigEndian.Uint16(packet[6:8])) + int(binary.BigEndian.Uint16(packet[8:10])) +
+		int(binary.BigEndian.Uint16(packet[10:12]))
+	ttlOffsets := make([]uint16, 0, rrCount)
+	for i := 0; i < rrCount; i++ {
+		if offset, err = skipPacketName(packet, offset); err != nil {
+			return nil, err
+		}
+		if offset+10 > len(packet) {
+			return nil, errors.New("Truncated record")
+		}
+		if binary.BigEndian.Uint16(packet[offset:offset+2]) != dns.TypeOPT {
+			ttlOffsets = append(ttlOffsets, uint16(offset+4))
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(packet[offset+8:offset+10]))
+	}
+	if offset > len(packet) {
+		return nil, errors.New("Truncated record")
+	}
+	return ttlOffsets, nil
+}
+
+func skipPacketName(packet []byte, offset int) (int, error) {
+	for {
+		if offset >= len(packet) {
+			return 0, errors.New("Truncated name")
+		}
+		labelLen := int(packet[offset])
+		switch {
+		case labelLen == 0:
+			return offset + 1, nil
+		case labelLen&0xc0 == 0xc0:
+			return offset + 2, nil
+		case labelLen&0xc0 != 0:
+			return 0, errors.New("Unsupported label type")
+		}
+		offset += 1 + labelLen
+	}
+}
+
+// minimalResponse builds a response to a query without parsing it, made of the header and the question only,
+// so that it is never larger than the query. Nil is returned if the packet is not a query.
+func minimalResponse(query []byte, rcode int, truncated bool) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return nil
+	}
+	length, qdCount := 12, uint16(0)
+	if binary.BigEndian.Uint16(query[4:6]) == 1 {
+		if offset, err := skipPacketName(query, 12); err == nil && offset+4 <= len(query) {
+			length, qdCount = offset+4, 1
+		}
+	}
+	response := make([]byte, length)
+	copy(response, query[:length])
+	response[2] = 0x80 | query[2]&0x79 // QR, opcode and RD
+	if truncated {
+		response[2] |= 0x02
+	}
+	response[3] = byte(rcode & 0x0f)
+	binary.BigEndian.PutUint16(response[4:6], qdCount)
+	for i := 6; i < 12; i++ {
+		response[i] = 0
+	}
+	return response
+}
@@ -0,0 +1,389 @@
+package dnscrypt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	netproxy "golang.org/x/net/proxy"
+)
+
+const (
+	DoTIdleTimeout = 30 * time.Second
+)
+
+var errDoTConnectionClosed = errors.New("DoT connection closed")
+
+// DoTClient keeps a single persistent connection to a DoT server.
+// Queries are pipelined, and responses are matched using their transaction ID.
+type DoTClient struct {
+	sync.Mutex
+	proxy      *Proxy
+	name       string
+	serverAddr string
+	tlsConfig  *tls.Config
+	hashes     [][]byte
+	conn       *dotConn
+	dialing    *dotDial
+	closed     bool
+	notAfter   time.Time
+}
+
+// dotDial is a connection being established, that concurrent queries wait for
+type dotDial struct {
+	done chan struct{}
+	conn *dotConn
+	err  error
+}
+
+type dotConn struct {
+	sync.Mutex
+	conn      net.Conn
+	writeLock sync.Mutex
+	pending   map[uint16]chan []byte
+	err       error
+}
+
+func NewDoTClient(proxy *Proxy, name string, serverAddr string, hostName string, hashes [][]byte) *DoTClient {
+	serverName, _ := ExtractHostAndPort(hostName, DefaultDoTPort)
+	tlsConfig := &tls.Config{
+		ServerName:             serverName,
+		SessionTicketsDisabled: proxy.XTransport.TLSDisableSessionTickets,
+	}
+	if !proxy.XTransport.TLSDisableSessionTickets {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+	if proxy.XTransport.TLSCipherSuite != nil {
+		tlsConfig.PreferServerCipherSuites = false
+		tlsConfig.CipherSuites = proxy.XTransport.TLSCipherSuite
+	}
+	return &DoTClient{
+		proxy:      proxy,
+		name:       name,
+		serverAddr: serverAddr,
+		tlsConfig:  tlsConfig,
+		hashes:     hashes,
+	}
+}
+
+func (client *DoTClient) dial(timeout time.Duration) (*dotConn, time.Time, error) {
+	var rawConn net.Conn
+	var err error
+	proxyDialer := client.proxy.XTransport.ProxyDialer
+	if proxyDialer == nil {
+		rawConn, err = net.DialTimeout("tcp", client.serverAddr, timeout)
+	} else {
+		rawConn, err = dialWithTimeout(*proxyDialer, "tcp", client.serverAddr, timeout)
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	rawConn.SetDeadline(time.Now().Add(timeout))
+	tlsConn := tls.Client(rawConn, client.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, time.Time{}, err
+	}
+	state := tlsConn.ConnectionState()
+	if err := verifyCertHashes(client.proxy, client.name, &state, client.hashes); err != nil {
+		tlsConn.Close()
+		return nil, time.Time{}, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	conn := &dotConn{
+		conn:    tlsConn,
+		pending: make(map[uint16]chan []byte),
+	}
+	go client.reader(conn)
+	return conn, peerCertNotAfter(&state), nil
+}
+
+// dialWithTimeout connects through a proxy, giving up after timeout even if the proxy dialer doesn't support contexts
+func dialWithTimeout(dialer netproxy.Dialer, network string, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if contextDialer, ok := dialer.(netproxy.ContextDialer); ok {
+		return contextDialer.DialContext(ctx, network, address)
+	}
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	resultChan := make(chan dialResult, 1)
+	go func() {
+		conn, err := dialer.Dial(network, address)
+		resultChan <- dialResult{conn, err}
+	}()
+	select {
+	case result := <-resultChan:
+		return result.conn, result.err
+	case <-ctx.Done():
+		go func() {
+			if result := <-resultChan; result.conn != nil {
+				result.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (client *DoTClient) reader(conn *dotConn) {
+	netConn := conn.conn
+	for {
+		netConn.SetReadDeadline(time.Now().Add(DoTIdleTimeout))
+		packet, started, err := readDoTResponse(netConn)
+		if err != nil {
+			// Waiting for pending responses can go on only if no bytes of the next one were read.
+			// Otherwise, the connection is marked as failed before new queries can be registered.
+			conn.Lock()
+			neterr, ok := err.(net.Error)
+			resumable := ok && neterr.Timeout() && !started && len(conn.pending) > 0
+			if !resumable && conn.err == nil {
+				conn.err = err
+			}
+			conn.Unlock()
+			if resumable {
+				continue
+			}
+			client.fail(conn, err)
+			return
+		}
+		tid := TransactionID(packet)
+		conn.Lock()
+		responseChan, ok := conn.pending[tid]
+		if ok {
+			delete(conn.pending, tid)
+		}
+		conn.Unlock()
+		if !ok {
+			dlog.Debugf("[%s] Unexpected DoT response", client.name)
+			continue
+		}
+		responseChan <- packet
+		client.closeIfDrained(conn)
+	}
+}
+
+// readDoTResponse reads a response prefixed with its length.
+// started is true if some bytes were read, in which case the stream can't be resumed after an error.
+func readDoTResponse(conn net.Conn) (packet []byte, started bool, err error) {
+	var prefix [2]byte
+	n, err := io.ReadFull(conn, prefix[:])
+	if err != nil {
+		return nil, n > 0, err
+	}
+	packetLength := int(binary.BigEndian.Uint16(prefix[:]))
+	if packetLength < MinDNSPacketSize || packetLength > MaxDNSPacketSize-1 {
+		return nil, true, errors.New("Unexpected DoT response size")
+	}
+	packet = make([]byte, packetLength)
+	if _, err := io.ReadFull(conn, packet); err != nil {
+		return nil, true, err
+	}
+	return packet, true, nil
+}
+
+func (client *DoTClient) fail(conn *dotConn, err error) {
+	client.Lock()
+	if client.conn == conn {
+		client.conn = nil
+	}
+	client.Unlock()
+	conn.Lock()
+	if conn.err == nil {
+		conn.err = err
+	}
+	for tid, responseChan := range conn.pending {
+		close(responseChan)
+		delete(conn.pending, tid)
+	}
+	conn.Unlock()
+	conn.conn.Close()
+}
+
+func (client *DoTClient) closeIfDrained(conn *dotConn) {
+	client.Lock()
+	closed := client.closed
+	client.Unlock()
+	if !closed {
+		return
+	}
+	conn.Lock()
+	drained := len(conn.pending) == 0
+	if drained && conn.err == nil {
+		conn.err = errDoTConnectionClosed
+	}
+	conn.Unlock()
+	if drained {
+		client.fail(conn, errDoTConnectionClosed)
+	}
+}
+
+// getConn returns the current connection, or establishes a new one.
+// The client isn't locked while connecting, and concurrent queries wait for the same connection.
+func (client *DoTClient) getConn(timeout time.Duration) (*dotConn, error) {
+	client.Lock()
+	if client.closed {
+		client.Unlock()
+		return nil, errDoTConnectionClosed
+	}
+	if conn := client.conn; conn != nil {
+		if !conn.failed() {
+			client.Unlock()
+			return conn, nil
+		}
+		client.conn = nil
+	}
+	if dial := client.dialing; dial != nil {
+		client.Unlock()
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-dial.done:
+			return dial.conn, dial.err
+		case <-timer.C:
+			return nil, dotTimeoutError{}
+		}
+	}
+	dial := &dotDial{done: make(chan struct{})}
+	client.dialing = dial
+	client.Unlock()
+
+	conn, notAfter, err := client.dial(timeout)
+	client.Lock()
+	client.dialing = nil
+	closed := client.closed
+	if err == nil && !closed {
+		client.conn = conn
+		client.notAfter = notAfter
+	}
+	client.Unlock()
+	if err == nil && closed {
+		client.fail(conn, errDoTConnectionClosed)
+		conn, err = nil, errDoTConnectionClosed
+	}
+	dial.conn, dial.err = conn, err
+	close(dial.done)
+	return conn, err
+}
+
+// certNotAfter returns the expiration date of the certificate presented by the server
+func (client *DoTClient) certNotAfter() time.Time {
+	client.Lock()
+	defer client.Unlock()
+	return client.notAfter
+}
+
+// Exchange sends a query and waits for the matching response
+func (client *DoTClient) Exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	responseChan := make(chan []byte, 1)
+	var conn *dotConn
+	var tid uint16
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, err = client.getConn(timeout)
+		if err != nil {
+			return nil, err
+		}
+		tid, err = conn.register(TransactionID(query), responseChan)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	originalTid := TransactionID(query)
+	packet := append([]byte{}, query...)
+	SetTransactionID(packet, tid)
+	packet, err = PrefixWithSize(packet)
+	if err != nil {
+		client.forget(conn, tid)
+		return nil, err
+	}
+	conn.writeLock.Lock()
+	conn.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err = conn.conn.Write(packet)
+	conn.writeLock.Unlock()
+	if err != nil {
+		client.fail(conn, err)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-responseChan:
+		if !ok {
+			conn.Lock()
+			err := conn.err
+			conn.Unlock()
+			if err == nil {
+				err = errDoTConnectionClosed
+			}
+			return nil, err
+		}
+		SetTransactionID(response, originalTid)
+		return response, nil
+	case <-timer.C:
+		client.forget(conn, tid)
+		return nil, dotTimeoutError{}
+	}
+}
+
+// failed tells whether the connection can't be used for new queries any more
+func (conn *dotConn) failed() bool {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.err != nil
+}
+
+// register reserves a transaction ID that is not used by any pending query
+func (conn *dotConn) register(tid uint16, responseChan chan []byte) (uint16, error) {
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	for i := 0; ; i++ {
+		if _, inUse := conn.pending[tid]; !inUse {
+			break
+		}
+		if i >= 0xffff {
+			return 0, errors.New("Too many pending DoT queries")
+		}
+		tid++
+	}
+	conn.pending[tid] = responseChan
+	return tid, nil
+}
+
+func (client *DoTClient) forget(conn *dotConn, tid uint16) {
+	conn.Lock()
+	delete(conn.pending, tid)
+	conn.Unlock()
+	client.closeIfDrained(conn)
+}
+
+// Close prevents new queries from being sent, and closes the connection
+// as soon as pending queries have been answered
+func (client *DoTClient) Close() {
+	client.Lock()
+	client.closed = true
+	conn := client.conn
+	client.Unlock()
+	if conn != nil {
+		client.closeIfDrained(conn)
+	}
+}
+
+type dotTimeoutError struct{}
+
+func (dotTimeoutError) Error() string   { return "DoT query timeout" }
+func (dotTimeoutError) Timeout() bool   { return true }
+func (dotTimeoutError) Temporary() bool { return true }
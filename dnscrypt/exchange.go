@@ -0,0 +1,86 @@
+package dnscrypt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ExchangeInfo describes how a query sent with Exchange was processed
+type ExchangeInfo struct {
+	// ServerName is the name of the server the query was forwarded to, or an empty string if it was answered locally
+	ServerName string
+	// CacheHit is true if the response was served from the cache
+	CacheHit bool
+	// ReturnCode is the outcome recorded by the plugins
+	ReturnCode PluginsReturnCode
+	// RTT is the time spent waiting for the server, or zero if the query was answered locally
+	RTT time.Duration
+}
+
+var exchangeClientAddr net.Addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// Exchange resolves a query the same way queries received by the listeners are resolved:
+// the query and response plugins are applied, the cache is used, and the query is logged.
+// The clientProto seen by the plugins is "internal".
+// An error is returned if no response was produced, info.ReturnCode then telling why.
+func (proxy *Proxy) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, ExchangeInfo, error) {
+	var info ExchangeInfo
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, info, err
+	}
+	if len(packet) < MinDNSPacketSize || len(packet) > MaxDNSPacketSize {
+		return nil, info, errors.New("Unexpected query size")
+	}
+	proxy.lifecycleLock.Lock()
+	if proxy.stopping {
+		proxy.lifecycleLock.Unlock()
+		return nil, info, errors.New("Proxy is shutting down")
+	}
+	proxy.inFlight.Add(1)
+	proxy.lifecycleLock.Unlock()
+
+	type result struct {
+		response []byte
+		info     ExchangeInfo
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		defer proxy.inFlight.Done()
+		start := time.Now()
+		clientAddr := exchangeClientAddr
+		serverInfo := proxy.ServersInfo.getOne()
+		pluginsState := NewPluginsState(proxy, "internal", &clientAddr, start)
+		response := proxy.processQuery(&pluginsState, serverInfo, proxy.MainProto, packet)
+		pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+		proxy.metrics.countQuery(&pluginsState, serverInfo)
+		info := ExchangeInfo{
+			CacheHit:   pluginsState.cacheHit,
+			ReturnCode: pluginsState.returnCode,
+			RTT:        pluginsState.serverRtt,
+		}
+		if serverInfo != nil && pluginsState.action == PluginsActionForward {
+			info.ServerName = serverInfo.Name
+		}
+		resultChan <- result{response: response, info: info}
+	}()
+	var res result
+	select {
+	case res = <-resultChan:
+	case <-ctx.Done():
+		return nil, info, ctx.Err()
+	}
+	if len(res.response) == 0 {
+		return nil, res.info, fmt.Errorf("No response to the query: [%s]", PluginsReturnCodeToString[res.info.ReturnCode])
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(res.response); err != nil {
+		return nil, res.info, err
+	}
+	return response, res.info, nil
+}
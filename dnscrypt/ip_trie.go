@@ -0,0 +1,94 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"net"
+)
+
+// IPTrie is a binary trie of IP networks, each one having an optional value, looked up bit by bit.
+// IPv4 networks are stored as IPv4-mapped IPv6 networks, so that IPv4-mapped IPv6 addresses match them.
+type IPTrie struct {
+	root ipTrieNode
+}
+
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	network  *net.IPNet
+	value    interface{}
+}
+
+func NewIPTrie() *IPTrie {
+	return &IPTrie{}
+}
+
+// Insert adds a network to the trie, replacing the value of the network if it was already present
+func (trie *IPTrie) Insert(network *net.IPNet, value interface{}) {
+	ip := network.IP.To16()
+	prefixLen, bits := network.Mask.Size()
+	if bits == 32 {
+		prefixLen += 96
+	}
+	node := &trie.root
+	for i := 0; i < prefixLen; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &ipTrieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.network, node.value = network, value
+}
+
+// InsertRange adds the smallest set of networks covering a range of addresses, both ends included
+func (trie *IPTrie) InsertRange(start net.IP, end net.IP, value interface{}) error {
+	bits := 128
+	if start4, end4 := start.To4(), end.To4(); start4 != nil && end4 != nil {
+		start, end, bits = start4, end4, 32
+	} else if start4 != nil || end4 != nil {
+		return errors.New("Addresses of a range must be of the same family")
+	}
+	if bytes.Compare(start, end) > 0 {
+		return errors.New("The start of a range must not be after its end")
+	}
+	one := big.NewInt(1)
+	current, last := new(big.Int).SetBytes(start), new(big.Int).SetBytes(end)
+	for current.Cmp(last) <= 0 {
+		hostBits := 0
+		for hostBits < bits && current.Bit(hostBits) == 0 {
+			blockEnd := new(big.Int).Lsh(one, uint(hostBits+1))
+			blockEnd.Add(blockEnd, current).Sub(blockEnd, one)
+			if blockEnd.Cmp(last) > 0 {
+				break
+			}
+			hostBits++
+		}
+		ip := make(net.IP, bits/8)
+		currentBin := current.Bytes()
+		copy(ip[len(ip)-len(currentBin):], currentBin)
+		trie.Insert(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits-hostBits, bits)}, value)
+		current.Add(current, new(big.Int).Lsh(one, uint(hostBits)))
+	}
+	return nil
+}
+
+// Lookup returns the most specific network containing an address and its value, or nil if there isn't any
+func (trie *IPTrie) Lookup(ip net.IP) (*net.IPNet, interface{}) {
+	ip = ip.To16()
+	if ip == nil {
+		return nil, nil
+	}
+	node := &trie.root
+	found := node
+	for i := 0; i < 128; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if node = node.children[bit]; node == nil {
+			break
+		}
+		if node.network != nil {
+			found = node
+		}
+	}
+	return found.network, found.value
+}
@@ -0,0 +1,162 @@
+package dnscrypt
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultLocalDoHPath = "/dns-query"
+)
+
+type localDoHHandler struct {
+	proxy     *Proxy
+	localAddr net.Addr
+	clientACL *ClientACL
+}
+
+func (handler localDoHHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	proxy := handler.proxy
+	dataType := "application/dns-message"
+	writer.Header().Set("Server", "dnscrypt-proxy")
+	if request.URL.Path != proxy.LocalDoHPath {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	start := time.Now()
+	var packet []byte
+	var err error
+	switch request.Method {
+	case "POST":
+		if contentType := request.Header.Get("Content-Type"); !strings.EqualFold(contentType, dataType) {
+			writer.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		packet, err = ioutil.ReadAll(io.LimitReader(request.Body, int64(MaxDNSPacketSize)))
+		if err != nil {
+			dlog.Debugf("Unable to read the body of a local DoH query: [%s]", err)
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	case "GET":
+		encodedPacket := request.URL.Query().Get("dns")
+		if len(encodedPacket) < MinDNSPacketSize*4/3 || len(encodedPacket) > MaxDNSPacketSize*4/3+4 {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		packet, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(encodedPacket, "="))
+		if err != nil {
+			dlog.Debugf("Unable to decode a local DoH query: [%s]", err)
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if len(packet) < MinDNSPacketSize || len(packet) > MaxDNSPacketSize {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	clientAddr, err := net.ResolveTCPAddr("tcp", request.RemoteAddr)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	xClientAddr := net.Addr(clientAddr)
+	if !handler.clientACL.allows(xClientAddr) {
+		proxy.noticeDeniedClient(xClientAddr, handler.localAddr)
+		if proxy.DeniedClientAction != DeniedClientActionRefused {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		writeLocalDoHResponse(writer, minimalResponse(packet, dns.RcodeRefused, false))
+		return
+	}
+	if rateLimit := proxy.rateLimitedQuery(xClientAddr, true); rateLimit != nil {
+		if rateLimit.Action != RateLimitActionRefused {
+			writer.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		writeLocalDoHResponse(writer, minimalResponse(packet, dns.RcodeRefused, false))
+		return
+	}
+	if !proxy.clientsCountInc() {
+		dlog.Warnf("Too many connections (max=%d)", proxy.MaxClients)
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer proxy.clientsCountDec()
+	response := proxy.processIncomingQuery(proxy.ServersInfo.getOne(), "doh", proxy.MainProto, packet, &xClientAddr, nil, start)
+	writeLocalDoHResponse(writer, response)
+}
+
+func writeLocalDoHResponse(writer http.ResponseWriter, response []byte) {
+	if len(response) == 0 {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/dns-message")
+	writer.Header().Set("Content-Length", fmt.Sprint(len(response)))
+	if maxAge, ok := localDoHMaxAge(response); ok {
+		writer.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	}
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(response)
+}
+
+// The freshness lifetime of a DoH response is the smallest TTL of its records (RFC 8484, section 5.1)
+func localDoHMaxAge(packet []byte) (uint32, bool) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		return 0, false
+	}
+	found, maxAge := false, uint32(0)
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || header.Ttl < maxAge {
+				found, maxAge = true, header.Ttl
+			}
+		}
+	}
+	return maxAge, found
+}
+
+func (proxy *Proxy) localDoHListener(acceptPc *net.TCPListener) {
+	defer acceptPc.Close()
+	httpServer := &http.Server{
+		ReadTimeout:  proxy.Timeout,
+		WriteTimeout: proxy.Timeout,
+		Handler:      localDoHHandler{proxy: proxy, localAddr: acceptPc.Addr(), clientACL: proxy.listenerClientACL(acceptPc.Addr())},
+		TLSConfig:    proxy.localDoHTLSConfig,
+	}
+	httpServer.SetKeepAlivesEnabled(true)
+	proxy.addCloser(httpServer.Shutdown)
+	if err := httpServer.ServeTLS(acceptPc, "", ""); err != nil {
+		dlog.Debugf("Local DoH server stopped: [%s]", err)
+	}
+}
+
+func (proxy *Proxy) localDoHListenerFromAddr(listenAddr *net.TCPAddr) error {
+	acceptPc, err := net.ListenTCP("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	dlog.Noticef("Now listening to https://%v%v [DoH]", listenAddr, proxy.LocalDoHPath)
+	proxy.serveStream(acceptPc, proxy.localDoHListener)
+	return nil
+}
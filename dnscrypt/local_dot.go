@@ -0,0 +1,43 @@
+package dnscrypt
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	LocalDoTIdleTimeout = 10 * time.Second
+)
+
+func (proxy *Proxy) localDoTListener(acceptPc *net.TCPListener) {
+	defer acceptPc.Close()
+	localAddr := acceptPc.Addr()
+	clientACL := proxy.listenerClientACL(localAddr)
+	for {
+		clientPc, err := acceptPc.Accept()
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				continue
+			}
+			return
+		}
+		if !clientACL.allows(clientPc.RemoteAddr()) {
+			proxy.denyStreamClient(tls.Server(clientPc, proxy.localDoTTLSConfig), localAddr)
+			continue
+		}
+		proxy.goSession(tls.Server(clientPc, proxy.localDoTTLSConfig), "dot", proxy.MainProto, LocalDoTIdleTimeout)
+	}
+}
+
+func (proxy *Proxy) localDoTListenerFromAddr(listenAddr *net.TCPAddr) error {
+	acceptPc, err := net.ListenTCP("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	dlog.Noticef("Now listening to %v [DoT]", listenAddr)
+	proxy.serveStream(acceptPc, proxy.localDoTListener)
+	return nil
+}
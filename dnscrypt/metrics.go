@@ -0,0 +1,329 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const DefaultMetricsPath = "/metrics"
+
+var metricsRTTBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricsQueryKey struct {
+	clientProto string
+	server      string
+	returnCode  PluginsReturnCode
+}
+
+type metricsHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// Metrics keeps the counters exposed in the Prometheus text format.
+// A nil *Metrics is valid and ignores everything it is given.
+type Metrics struct {
+	sync.Mutex
+	queries      map[metricsQueryKey]uint64
+	cacheHits    map[string]uint64
+	cacheMisses  map[string]uint64
+	serverRtts   map[string]*metricsHistogram
+	serverErrors map[string]uint64
+	denied       map[string]uint64
+	rateLimited  map[string]uint64
+	liveServers  int
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		queries:      make(map[metricsQueryKey]uint64),
+		cacheHits:    make(map[string]uint64),
+		cacheMisses:  make(map[string]uint64),
+		serverRtts:   make(map[string]*metricsHistogram),
+		serverErrors: make(map[string]uint64),
+		denied:       make(map[string]uint64),
+		rateLimited:  make(map[string]uint64),
+	}
+}
+
+func (metrics *Metrics) countQuery(pluginsState *PluginsState, serverInfo *ServerInfo) {
+	if metrics == nil {
+		return
+	}
+	server := "-"
+	if serverInfo != nil && pluginsState.action == PluginsActionForward {
+		server = serverInfo.Name
+	}
+	key := metricsQueryKey{clientProto: pluginsState.clientProto, server: server, returnCode: pluginsState.returnCode}
+	metrics.Lock()
+	metrics.queries[key]++
+	metrics.Unlock()
+}
+
+func (metrics *Metrics) countCacheLookup(clientProto string, hit bool) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	if hit {
+		metrics.cacheHits[clientProto]++
+	} else {
+		metrics.cacheMisses[clientProto]++
+	}
+	metrics.Unlock()
+}
+
+func (metrics *Metrics) observeServerRtt(server string, rtt time.Duration) {
+	if metrics == nil {
+		return
+	}
+	seconds := rtt.Seconds()
+	metrics.Lock()
+	histogram := metrics.serverRtts[server]
+	if histogram == nil {
+		histogram = &metricsHistogram{buckets: make([]uint64, len(metricsRTTBuckets))}
+		metrics.serverRtts[server] = histogram
+	}
+	for i, bound := range metricsRTTBuckets {
+		if seconds <= bound {
+			histogram.buckets[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+	metrics.Unlock()
+}
+
+func (metrics *Metrics) countServerError(server string) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	metrics.serverErrors[server]++
+	metrics.Unlock()
+}
+
+func (metrics *Metrics) countDeniedClient(listener string) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	metrics.denied[listener]++
+	metrics.Unlock()
+}
+
+func (metrics *Metrics) countRateLimited(action string) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	metrics.rateLimited[action]++
+	metrics.Unlock()
+}
+
+func (metrics *Metrics) setLiveServers(liveServers int) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	metrics.liveServers = liveServers
+	metrics.Unlock()
+}
+
+// startMetricsServer serves the metrics over HTTP
+func (proxy *Proxy) startMetricsServer() error {
+	if proxy.metrics == nil {
+		return nil
+	}
+	var listeners []net.Listener
+	closeListeners := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	for _, listenAddrStr := range proxy.MetricsListenAddresses {
+		listener, err := net.Listen("tcp", listenAddrStr)
+		if err != nil {
+			closeListeners()
+			return fmt.Errorf("Unable to start the metrics server: [%s]", err)
+		}
+		listeners = append(listeners, listener)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(proxy.MetricsPath, proxy.serveMetrics)
+	httpServer := &http.Server{
+		ReadTimeout: proxy.Timeout,
+		Handler:     mux,
+	}
+	if !proxy.addCloser(httpServer.Shutdown) {
+		closeListeners()
+		return nil
+	}
+	for _, listener := range listeners {
+		listener := listener
+		dlog.Noticef("Now listening to %v%v [metrics]", listener.Addr(), proxy.MetricsPath)
+		proxy.goBackground(func() {
+			if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+				dlog.Warnf("Metrics server stopped: [%s]", err)
+			}
+		})
+	}
+	return nil
+}
+
+func (proxy *Proxy) serveMetrics(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		writer.Header().Set("Allow", "GET, HEAD")
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writer.Header().Set("Server", "dnscrypt-proxy")
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer.Write(proxy.metricsText())
+}
+
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (w *metricsWriter) header(name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (w *metricsWriter) sample(name string, labels []string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], metricsEscaper.Replace(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.WriteByte('\n')
+}
+
+var metricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedMetricsKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsText renders the current metrics in the Prometheus text exposition format
+func (proxy *Proxy) metricsText() []byte {
+	metrics := proxy.metrics
+	w := &metricsWriter{}
+	metrics.Lock()
+
+	w.header("dnscrypt_proxy_queries_total", "counter", "Queries processed, by client protocol, server and return code.")
+	queryKeys := make([]metricsQueryKey, 0, len(metrics.queries))
+	for key := range metrics.queries {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Slice(queryKeys, func(i, j int) bool {
+		a, b := queryKeys[i], queryKeys[j]
+		if a.clientProto != b.clientProto {
+			return a.clientProto < b.clientProto
+		}
+		if a.server != b.server {
+			return a.server < b.server
+		}
+		return a.returnCode < b.returnCode
+	})
+	for _, key := range queryKeys {
+		w.sample("dnscrypt_proxy_queries_total", []string{
+			"client_proto", key.clientProto,
+			"server", key.server,
+			"return_code", PluginsReturnCodeToString[key.returnCode],
+		}, float64(metrics.queries[key]))
+	}
+
+	w.header("dnscrypt_proxy_cache_hits_total", "counter", "Queries answered from the cache, by client protocol.")
+	for _, clientProto := range sortedMetricsKeys(metrics.cacheHits) {
+		w.sample("dnscrypt_proxy_cache_hits_total", []string{"client_proto", clientProto}, float64(metrics.cacheHits[clientProto]))
+	}
+	w.header("dnscrypt_proxy_cache_misses_total", "counter", "Queries not found in the cache, by client protocol.")
+	for _, clientProto := range sortedMetricsKeys(metrics.cacheMisses) {
+		w.sample("dnscrypt_proxy_cache_misses_total", []string{"client_proto", clientProto}, float64(metrics.cacheMisses[clientProto]))
+	}
+
+	w.header("dnscrypt_proxy_server_rtt_seconds", "histogram", "Time spent waiting for successful responses from servers.")
+	servers := make([]string, 0, len(metrics.serverRtts))
+	for server := range metrics.serverRtts {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		histogram := metrics.serverRtts[server]
+		for i, bound := range metricsRTTBuckets {
+			w.sample("dnscrypt_proxy_server_rtt_seconds_bucket", []string{
+				"server", server,
+				"le", strconv.FormatFloat(bound, 'g', -1, 64),
+			}, float64(histogram.buckets[i]))
+		}
+		w.sample("dnscrypt_proxy_server_rtt_seconds_bucket", []string{"server", server, "le", "+Inf"}, float64(histogram.count))
+		w.sample("dnscrypt_proxy_server_rtt_seconds_sum", []string{"server", server}, histogram.sum)
+		w.sample("dnscrypt_proxy_server_rtt_seconds_count", []string{"server", server}, float64(histogram.count))
+	}
+	w.header("dnscrypt_proxy_server_errors_total", "counter", "Failed exchanges with servers.")
+	for _, server := range sortedMetricsKeys(metrics.serverErrors) {
+		w.sample("dnscrypt_proxy_server_errors_total", []string{"server", server}, float64(metrics.serverErrors[server]))
+	}
+
+	w.header("dnscrypt_proxy_denied_queries_total", "counter", "Queries and connections from clients denied by the access control lists, by listener.")
+	for _, listener := range sortedMetricsKeys(metrics.denied) {
+		w.sample("dnscrypt_proxy_denied_queries_total", []string{"listener", listener}, float64(metrics.denied[listener]))
+	}
+
+	w.header("dnscrypt_proxy_rate_limited_queries_total", "counter", "Queries from clients exceeding their rate limit, by action.")
+	for _, action := range sortedMetricsKeys(metrics.rateLimited) {
+		w.sample("dnscrypt_proxy_rate_limited_queries_total", []string{"action", action}, float64(metrics.rateLimited[action]))
+	}
+
+	w.header("dnscrypt_proxy_live_servers", "gauge", "Servers found to be usable by the last certificates refresh.")
+	w.sample("dnscrypt_proxy_live_servers", nil, float64(metrics.liveServers))
+	metrics.Unlock()
+
+	w.header("dnscrypt_proxy_clients", "gauge", "Clients currently being served.")
+	w.sample("dnscrypt_proxy_clients", nil, float64(atomic.LoadUint32(&proxy.clientsCount)))
+	w.header("dnscrypt_proxy_max_clients", "gauge", "Maximum number of clients served simultaneously.")
+	w.sample("dnscrypt_proxy_max_clients", nil, float64(proxy.MaxClients))
+
+	w.header("dnscrypt_proxy_source_age_seconds", "gauge", "Time since the cache file of a source was last downloaded.")
+	now := time.Now()
+	seenCacheFiles := make(map[string]bool)
+	for _, urlToPrefetch := range proxy.URLsToPrefetch {
+		cacheFile := urlToPrefetch.cacheFile
+		if strings.HasSuffix(cacheFile, ".minisig") || seenCacheFiles[cacheFile] {
+			continue
+		}
+		seenCacheFiles[cacheFile] = true
+		info, err := os.Stat(cacheFile)
+		if err != nil {
+			continue
+		}
+		w.sample("dnscrypt_proxy_source_age_seconds", []string{"source", cacheFile}, now.Sub(info.ModTime()).Seconds())
+	}
+	return w.Bytes()
+}
@@ -0,0 +1,337 @@
+package dnscrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Oblivious DoH (RFC 9230), using HPKE (RFC 9180) in base mode with
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and AES-128-GCM
+
+const (
+	ODoHConfigsPath = "/.well-known/odohconfigs"
+	ODoHVersion     = 0x0001
+)
+
+const (
+	hpkeKemX25519HKDFSHA256 = 0x0020
+	hpkeKdfHKDFSHA256       = 0x0001
+	hpkeAeadAES128GCM       = 0x0001
+	hpkeNk                  = 16
+	hpkeNn                  = 12
+	hpkeNh                  = 32
+	hpkeNsecret             = 32
+)
+
+const (
+	odohMessageTypeQuery    = 0x01
+	odohMessageTypeResponse = 0x02
+)
+
+var (
+	hpkeKemSuiteID = []byte{'K', 'E', 'M', 0x00, 0x20}
+	hpkeSuiteID    = []byte{'H', 'P', 'K', 'E', 0x00, 0x20, 0x00, 0x01, 0x00, 0x01}
+)
+
+// ODoHTargetConfig is a public key advertised by an ODoH target
+type ODoHTargetConfig struct {
+	contents  []byte
+	publicKey []byte
+	keyID     []byte
+}
+
+type odohQueryContext struct {
+	secret []byte
+	query  []byte
+}
+
+type hpkeContext struct {
+	key            []byte
+	baseNonce      []byte
+	exporterSecret []byte
+}
+
+func hkdfExtract(salt []byte, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(prk []byte, info []byte, length int) []byte {
+	out := make([]byte, 0, length+sha256.Size)
+	var previous []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(previous)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		previous = mac.Sum(nil)
+		out = append(out, previous...)
+	}
+	return out[:length]
+}
+
+func hpkeLabeledExtract(suiteID []byte, salt []byte, label string, ikm []byte) []byte {
+	labeledIkm := make([]byte, 0, 7+len(suiteID)+len(label)+len(ikm))
+	labeledIkm = append(labeledIkm, "HPKE-v1"...)
+	labeledIkm = append(labeledIkm, suiteID...)
+	labeledIkm = append(labeledIkm, label...)
+	labeledIkm = append(labeledIkm, ikm...)
+	return hkdfExtract(salt, labeledIkm)
+}
+
+func hpkeLabeledExpand(suiteID []byte, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := make([]byte, 2, 2+7+len(suiteID)+len(label)+len(info))
+	binary.BigEndian.PutUint16(labeledInfo[0:2], uint16(length))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	return hkdfExpand(prk, labeledInfo, length)
+}
+
+func hpkeSetupBaseSender(pkR []byte, info []byte) ([]byte, *hpkeContext, error) {
+	var skE [32]byte
+	if _, err := crypto_rand.Read(skE[:]); err != nil {
+		return nil, nil, err
+	}
+	return hpkeSetupBaseSenderWithKey(&skE, pkR, info)
+}
+
+func hpkeSetupBaseSenderWithKey(skE *[32]byte, pkR []byte, info []byte) ([]byte, *hpkeContext, error) {
+	if len(pkR) != 32 {
+		return nil, nil, errors.New("Invalid HPKE public key")
+	}
+	var pkE, pkRBytes, dh [32]byte
+	copy(pkRBytes[:], pkR)
+	curve25519.ScalarBaseMult(&pkE, skE)
+	curve25519.ScalarMult(&dh, skE, &pkRBytes)
+	if dh == [32]byte{} {
+		return nil, nil, errors.New("Weak HPKE public key")
+	}
+	kemContext := append(append([]byte{}, pkE[:]...), pkR...)
+	eaePrk := hpkeLabeledExtract(hpkeKemSuiteID, nil, "eae_prk", dh[:])
+	sharedSecret := hpkeLabeledExpand(hpkeKemSuiteID, eaePrk, "shared_secret", kemContext, hpkeNsecret)
+
+	pskIDHash := hpkeLabeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := hpkeLabeledExtract(hpkeSuiteID, nil, "info_hash", info)
+	keyScheduleContext := append(append([]byte{0x00}, pskIDHash...), infoHash...)
+	secret := hpkeLabeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	context := &hpkeContext{
+		key:            hpkeLabeledExpand(hpkeSuiteID, secret, "key", keyScheduleContext, hpkeNk),
+		baseNonce:      hpkeLabeledExpand(hpkeSuiteID, secret, "base_nonce", keyScheduleContext, hpkeNn),
+		exporterSecret: hpkeLabeledExpand(hpkeSuiteID, secret, "exp", keyScheduleContext, hpkeNh),
+	}
+	return pkE[:], context, nil
+}
+
+// seal encrypts the first, and only message of the context (sequence number 0)
+func (context *hpkeContext) seal(aad []byte, plaintext []byte) ([]byte, error) {
+	aead, err := newAES128GCM(context.key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, context.baseNonce, plaintext, aad), nil
+}
+
+func (context *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return hpkeLabeledExpand(hpkeSuiteID, context.exporterSecret, "sec", exporterContext, length)
+}
+
+func newAES128GCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func appendLengthPrefixed(out []byte, data []byte) []byte {
+	out = append(out, byte(len(data)>>8), byte(len(data)))
+	return append(out, data...)
+}
+
+func readLengthPrefixed(in []byte) ([]byte, []byte, error) {
+	if len(in) < 2 {
+		return nil, nil, errors.New("Short ODoH message")
+	}
+	length := int(binary.BigEndian.Uint16(in[0:2]))
+	if len(in)-2 < length {
+		return nil, nil, errors.New("Short ODoH message")
+	}
+	return in[2 : 2+length], in[2+length:], nil
+}
+
+// ParseODoHTargetConfigs returns the configurations of a target that use a supported version and cipher suite
+func ParseODoHTargetConfigs(encodedConfigs []byte) ([]ODoHTargetConfig, error) {
+	configsList, rest, err := readLengthPrefixed(encodedConfigs)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("Unexpected data after the ODoH configurations")
+	}
+	var configs []ODoHTargetConfig
+	for len(configsList) > 0 {
+		if len(configsList) < 4 {
+			return nil, errors.New("Short ODoH configuration")
+		}
+		version := binary.BigEndian.Uint16(configsList[0:2])
+		var contents []byte
+		contents, configsList, err = readLengthPrefixed(configsList[2:])
+		if err != nil {
+			return nil, err
+		}
+		if version != ODoHVersion || len(contents) < 8 {
+			continue
+		}
+		kemID := binary.BigEndian.Uint16(contents[0:2])
+		kdfID := binary.BigEndian.Uint16(contents[2:4])
+		aeadID := binary.BigEndian.Uint16(contents[4:6])
+		if kemID != hpkeKemX25519HKDFSHA256 || kdfID != hpkeKdfHKDFSHA256 || aeadID != hpkeAeadAES128GCM {
+			continue
+		}
+		publicKey, rest, err := readLengthPrefixed(contents[6:])
+		if err != nil || len(rest) != 0 || len(publicKey) != 32 {
+			continue
+		}
+		configs = append(configs, ODoHTargetConfig{
+			contents:  contents,
+			publicKey: publicKey,
+			keyID:     hkdfExpand(hkdfExtract(nil, contents), []byte("odoh key id"), hpkeNh),
+		})
+	}
+	return configs, nil
+}
+
+func (config *ODoHTargetConfig) encryptQuery(query []byte) ([]byte, *odohQueryContext, error) {
+	enc, context, err := hpkeSetupBaseSender(config.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	padLen := 63 - (len(query)+63)&63
+	plaintext := appendLengthPrefixed(nil, query)
+	plaintext = appendLengthPrefixed(plaintext, make([]byte, padLen))
+	aad := appendLengthPrefixed([]byte{odohMessageTypeQuery}, config.keyID)
+	ciphertext, err := context.seal(aad, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	encrypted := appendLengthPrefixed([]byte{odohMessageTypeQuery}, config.keyID)
+	encrypted = appendLengthPrefixed(encrypted, append(enc, ciphertext...))
+	queryContext := &odohQueryContext{
+		secret: context.export([]byte("odoh response"), hpkeNk),
+		query:  plaintext,
+	}
+	return encrypted, queryContext, nil
+}
+
+func (queryContext *odohQueryContext) decryptResponse(encrypted []byte) ([]byte, error) {
+	if len(encrypted) < 1 || encrypted[0] != odohMessageTypeResponse {
+		return nil, errors.New("Unexpected ODoH message type")
+	}
+	responseNonce, rest, err := readLengthPrefixed(encrypted[1:])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, rest, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("Unexpected data after the ODoH response")
+	}
+	salt := appendLengthPrefixed(append([]byte{}, queryContext.query...), responseNonce)
+	prk := hkdfExtract(salt, queryContext.secret)
+	aead, err := newAES128GCM(hkdfExpand(prk, []byte("odoh key"), hpkeNk))
+	if err != nil {
+		return nil, err
+	}
+	aad := appendLengthPrefixed([]byte{odohMessageTypeResponse}, responseNonce)
+	plaintext, err := aead.Open(nil, hkdfExpand(prk, []byte("odoh nonce"), hpkeNn), ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	response, padding, err := readLengthPrefixed(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	padding, rest, err = readLengthPrefixed(padding)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("Invalid ODoH response padding")
+	}
+	for _, b := range padding {
+		if b != 0 {
+			return nil, errors.New("Invalid ODoH response padding")
+		}
+	}
+	return response, nil
+}
+
+func fetchODoHTargetConfig(proxy *Proxy, name string, targetURL *url.URL) (*ODoHTargetConfig, error) {
+	configsURL := &url.URL{
+		Scheme: targetURL.Scheme,
+		Host:   targetURL.Host,
+		Path:   ODoHConfigsPath,
+	}
+	resp, _, err := proxy.XTransport.Get(configsURL, "", proxy.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	encodedConfigs, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxHTTPBodyLength))
+	if err != nil {
+		return nil, err
+	}
+	configs, err := ParseODoHTargetConfigs(encodedConfigs)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("No supported ODoH configuration for [%s]", name)
+	}
+	return &configs[0], nil
+}
+
+// odohRelayURL returns the URL to send queries for the target to, through a relay
+func odohRelayURL(relayURL *url.URL, targetURL *url.URL) *url.URL {
+	url := *relayURL
+	qs := url.Query()
+	qs.Set("targethost", targetURL.Host)
+	qs.Set("targetpath", targetURL.Path)
+	url.RawQuery = qs.Encode()
+	return &url
+}
+
+func (proxy *Proxy) exchangeWithODoHServer(serverInfo *ServerInfo, query []byte, timeout time.Duration) ([]byte, error) {
+	encryptedQuery, queryContext, err := serverInfo.odohTargetConfig.encryptQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	url := serverInfo.URL
+	if serverInfo.RelayURL != nil {
+		url = serverInfo.RelayURL
+	}
+	resp, _, err := proxy.XTransport.ObliviousDoHQuery(url, encryptedQuery, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	encryptedResponse, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxHTTPBodyLength))
+	if err != nil {
+		return nil, err
+	}
+	return queryContext.decryptResponse(encryptedResponse)
+}
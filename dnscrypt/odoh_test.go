@@ -0,0 +1,283 @@
+package dnscrypt
+
+import (
+	"bytes"
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	bin, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bin
+}
+
+// RFC 9180, appendix A.1.1: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM, base mode
+func TestHPKEBaseSenderVector(t *testing.T) {
+	var skE, skR, pkR [32]byte
+	copy(skE[:], mustDecodeHex(t, "52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736"))
+	copy(skR[:], mustDecodeHex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	curve25519.ScalarBaseMult(&pkR, &skR)
+	info := mustDecodeHex(t, "4f6465206f6e2061204772656369616e2055726e")
+	enc, context, err := hpkeSetupBaseSenderWithKey(&skE, pkR[:], info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		name  string
+		value []byte
+		hex   string
+	}{
+		{"enc", enc, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"},
+		{"key", context.key, "4531685d41d65f03dc48f6b8302c05b0"},
+		{"base_nonce", context.baseNonce, "56d890e5accaaf011cff4b7d"},
+		{"exporter_secret", context.exporterSecret, "45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"},
+	}
+	for _, e := range expected {
+		if hex.EncodeToString(e.value) != e.hex {
+			t.Errorf("Unexpected %s: [%x]", e.name, e.value)
+		}
+	}
+	ciphertext, err := context.seal(mustDecodeHex(t, "436f756e742d30"), mustDecodeHex(t, "4265617574792069732074727574682c20747275746820626561757479"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(ciphertext) != "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a" {
+		t.Errorf("Unexpected ciphertext: [%x]", ciphertext)
+	}
+}
+
+// odohTestTarget is a minimal ODoH target, answering every A query with 192.0.2.1
+type odohTestTarget struct {
+	secretKey [32]byte
+	config    []byte
+	keyID     []byte
+	queries   uint32
+}
+
+func newODoHTestTarget(t *testing.T) *odohTestTarget {
+	target := &odohTestTarget{}
+	if _, err := crypto_rand.Read(target.secretKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	var publicKey [32]byte
+	curve25519.ScalarBaseMult(&publicKey, &target.secretKey)
+	contents := make([]byte, 6)
+	binary.BigEndian.PutUint16(contents[0:2], hpkeKemX25519HKDFSHA256)
+	binary.BigEndian.PutUint16(contents[2:4], hpkeKdfHKDFSHA256)
+	binary.BigEndian.PutUint16(contents[4:6], hpkeAeadAES128GCM)
+	contents = appendLengthPrefixed(contents, publicKey[:])
+	config := appendLengthPrefixed([]byte{byte(ODoHVersion >> 8), byte(ODoHVersion)}, contents)
+	target.config = appendLengthPrefixed(nil, config)
+	target.keyID = hkdfExpand(hkdfExtract(nil, contents), []byte("odoh key id"), hpkeNh)
+	return target
+}
+
+// receiverContext sets up the HPKE context of the target for an encapsulated key
+func (target *odohTestTarget) receiverContext(enc []byte, info []byte) *hpkeContext {
+	var pkE, pkR, dh [32]byte
+	copy(pkE[:], enc)
+	curve25519.ScalarBaseMult(&pkR, &target.secretKey)
+	curve25519.ScalarMult(&dh, &target.secretKey, &pkE)
+	kemContext := append(append([]byte{}, enc...), pkR[:]...)
+	eaePrk := hpkeLabeledExtract(hpkeKemSuiteID, nil, "eae_prk", dh[:])
+	sharedSecret := hpkeLabeledExpand(hpkeKemSuiteID, eaePrk, "shared_secret", kemContext, hpkeNsecret)
+	pskIDHash := hpkeLabeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := hpkeLabeledExtract(hpkeSuiteID, nil, "info_hash", info)
+	keyScheduleContext := append(append([]byte{0x00}, pskIDHash...), infoHash...)
+	secret := hpkeLabeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	return &hpkeContext{
+		key:            hpkeLabeledExpand(hpkeSuiteID, secret, "key", keyScheduleContext, hpkeNk),
+		baseNonce:      hpkeLabeledExpand(hpkeSuiteID, secret, "base_nonce", keyScheduleContext, hpkeNn),
+		exporterSecret: hpkeLabeledExpand(hpkeSuiteID, secret, "exp", keyScheduleContext, hpkeNh),
+	}
+}
+
+func (target *odohTestTarget) answer(encryptedQuery []byte) ([]byte, error) {
+	if len(encryptedQuery) < 1 || encryptedQuery[0] != odohMessageTypeQuery {
+		return nil, errors.New("Unexpected message type")
+	}
+	keyID, rest, err := readLengthPrefixed(encryptedQuery[1:])
+	if err != nil || !bytes.Equal(keyID, target.keyID) {
+		return nil, errors.New("Unexpected key ID")
+	}
+	encapsulated, rest, err := readLengthPrefixed(rest)
+	if err != nil || len(rest) != 0 || len(encapsulated) < 32 {
+		return nil, errors.New("Invalid query")
+	}
+	context := target.receiverContext(encapsulated[:32], []byte("odoh query"))
+	aead, err := newAES128GCM(context.key)
+	if err != nil {
+		return nil, err
+	}
+	aad := appendLengthPrefixed([]byte{odohMessageTypeQuery}, keyID)
+	queryPlaintext, err := aead.Open(nil, context.baseNonce, encapsulated[32:], aad)
+	if err != nil {
+		return nil, err
+	}
+	packet, _, err := readLengthPrefixed(queryPlaintext)
+	if err != nil {
+		return nil, err
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		return nil, err
+	}
+	response := dns.Msg{}
+	response.SetReply(&msg)
+	response.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	}}
+	responsePacket, err := response.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	responseNonce := make([]byte, hpkeNk)
+	if _, err := crypto_rand.Read(responseNonce); err != nil {
+		return nil, err
+	}
+	secret := context.export([]byte("odoh response"), hpkeNk)
+	salt := appendLengthPrefixed(append([]byte{}, queryPlaintext...), responseNonce)
+	prk := hkdfExtract(salt, secret)
+	responseAead, err := newAES128GCM(hkdfExpand(prk, []byte("odoh key"), hpkeNk))
+	if err != nil {
+		return nil, err
+	}
+	plaintext := appendLengthPrefixed(nil, responsePacket)
+	plaintext = appendLengthPrefixed(plaintext, make([]byte, 16))
+	responseAad := appendLengthPrefixed([]byte{odohMessageTypeResponse}, responseNonce)
+	ciphertext := responseAead.Seal(nil, hkdfExpand(prk, []byte("odoh nonce"), hpkeNn), plaintext, responseAad)
+	encryptedResponse := appendLengthPrefixed([]byte{odohMessageTypeResponse}, responseNonce)
+	return appendLengthPrefixed(encryptedResponse, ciphertext), nil
+}
+
+func (target *odohTestTarget) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	switch request.URL.Path {
+	case ODoHConfigsPath:
+		writer.Write(target.config)
+	case "/dns-query":
+		if request.Method != "POST" || request.Header.Get("Content-Type") != "application/oblivious-dns-message" {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(request.Body)
+		response, err := target.answer(body)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddUint32(&target.queries, 1)
+		writer.Header().Set("Content-Type", "application/oblivious-dns-message")
+		writer.Write(response)
+	default:
+		writer.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newODoHTestRelay returns a relay forwarding queries to the target given in the query string
+func newODoHTestRelay(client *http.Client, relayed *uint32) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		qs := request.URL.Query()
+		targetURL := url.URL{Scheme: "https", Host: qs.Get("targethost"), Path: qs.Get("targetpath")}
+		resp, err := client.Post(targetURL.String(), request.Header.Get("Content-Type"), request.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		atomic.AddUint32(relayed, 1)
+		writer.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		writer.WriteHeader(resp.StatusCode)
+		writer.Write(body)
+	}))
+}
+
+func TestODoHRoundTrip(t *testing.T) {
+	target := newODoHTestTarget(t)
+	targetServer := httptest.NewTLSServer(target)
+	defer targetServer.Close()
+	relayed := uint32(0)
+	relayServer := newODoHTestRelay(targetServer.Client(), &relayed)
+	defer relayServer.Close()
+
+	xTransport := NewXTransport()
+	xTransport.RebuildTransport()
+	xTransport.transport.TLSClientConfig.RootCAs = targetServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	proxy := &Proxy{XTransport: xTransport, Timeout: 5 * time.Second}
+
+	targetURL, _ := url.Parse(targetServer.URL + "/dns-query")
+	relayURL, _ := url.Parse(relayServer.URL + "/proxy")
+	targetConfig, err := fetchODoHTargetConfig(proxy, "test", targetURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := dns.Msg{}
+	query.SetQuestion("example.com.", dns.TypeA)
+	packet, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, serverInfo := range []*ServerInfo{
+		{URL: targetURL, odohTargetConfig: targetConfig},
+		{URL: targetURL, RelayURL: odohRelayURL(relayURL, targetURL), odohTargetConfig: targetConfig},
+	} {
+		responsePacket, err := proxy.exchangeWithODoHServer(serverInfo, packet, proxy.Timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := dns.Msg{}
+		if err := response.Unpack(responsePacket); err != nil {
+			t.Fatal(err)
+		}
+		if response.Id != query.Id || len(response.Answer) != 1 {
+			t.Fatalf("Unexpected response: %v", response)
+		}
+		if a, ok := response.Answer[0].(*dns.A); !ok || !a.A.Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("Unexpected answer: %v", response.Answer[0])
+		}
+	}
+	if atomic.LoadUint32(&target.queries) != 2 || atomic.LoadUint32(&relayed) != 1 {
+		t.Errorf("Unexpected number of queries: %d received by the target, %d relayed", atomic.LoadUint32(&target.queries), atomic.LoadUint32(&relayed))
+	}
+}
+
+func TestODoHResponseTampering(t *testing.T) {
+	target := newODoHTestTarget(t)
+	configs, err := ParseODoHTargetConfigs(target.config)
+	if err != nil || len(configs) != 1 {
+		t.Fatal(configs, err)
+	}
+	query := dns.Msg{}
+	query.SetQuestion("example.com.", dns.TypeA)
+	packet, _ := query.Pack()
+	encryptedQuery, queryContext, err := configs[0].encryptQuery(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedResponse, err := target.answer(encryptedQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedResponse[len(encryptedResponse)-1] ^= 1
+	if _, err := queryContext.decryptResponse(encryptedResponse); err == nil {
+		t.Error("A tampered response was accepted")
+	}
+}
@@ -0,0 +1,146 @@
+package dnscrypt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+)
+
+type namePatternsFormat int
+
+const (
+	namePatternsFormatNative namePatternsFormat = iota
+	namePatternsFormatHosts
+	namePatternsFormatAdblock
+)
+
+var namePatternsFormatNames = map[namePatternsFormat]string{
+	namePatternsFormatNative:  "native",
+	namePatternsFormatHosts:   "hosts",
+	namePatternsFormatAdblock: "Adblock",
+}
+
+// hostsLocalNames are found in most hosts files, and are not meant to be blocked
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// unsupportedRuleError is returned for rules that are well formed, but that can't be applied to DNS queries
+type unsupportedRuleError struct {
+	reason string
+}
+
+func (err unsupportedRuleError) Error() string {
+	return err.reason
+}
+
+// detectNamePatternsFormat guesses the format of a list of rules from its first line that is not empty or a comment
+func detectNamePatternsFormat(lines []string) namePatternsFormat {
+	for _, line := range lines {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "|") || strings.HasPrefix(line, "@@") ||
+			strings.HasPrefix(strings.ToLower(line), "[adblock") {
+			return namePatternsFormatAdblock
+		}
+		if isHostsLine(line) {
+			return namePatternsFormatHosts
+		}
+		return namePatternsFormatNative
+	}
+	return namePatternsFormatNative
+}
+
+func isHostsLine(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) >= 2 && net.ParseIP(fields[0]) != nil
+}
+
+// hostsLinePatterns returns the names of a hosts file entry, as patterns matching them and their subdomains
+func hostsLinePatterns(line string) ([]string, error) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil, errors.New("An IP address followed by names was expected")
+	}
+	var patterns []string
+	for _, name := range fields[1:] {
+		name = strings.ToLower(StripTrailingDot(name))
+		if hostsLocalNames[name] {
+			continue
+		}
+		if strings.ContainsAny(name, "*?[]=@") {
+			return nil, fmt.Errorf("Unexpected character in [%s]", name)
+		}
+		patterns = append(patterns, name)
+	}
+	return patterns, nil
+}
+
+// adblockRulePattern translates a rule using the Adblock DNS syntax to a pattern.
+// ||name^ matches a name and its subdomains, |name^ only matches the name itself.
+// exception is true for rules starting with @@, and the pattern is empty for comments.
+func adblockRulePattern(rule string) (pattern string, exception bool, err error) {
+	if strings.HasPrefix(rule, "!") || strings.HasPrefix(rule, "[") {
+		return "", false, nil
+	}
+	for _, separator := range []string{"##", "#@#", "#?#", "#$#"} {
+		if strings.Contains(rule, separator) {
+			return "", false, unsupportedRuleError{"Cosmetic filters are not supported"}
+		}
+	}
+	if strings.HasPrefix(rule, "@@") {
+		exception = true
+		rule = rule[2:]
+	}
+	if i := strings.LastIndex(rule, "$"); i >= 0 {
+		for _, modifier := range strings.Split(rule[i+1:], ",") {
+			switch strings.ToLower(strings.TrimSpace(modifier)) {
+			case "important", "third-party", "popup":
+			default:
+				return "", exception, unsupportedRuleError{fmt.Sprintf("Unsupported modifier [%s]", modifier)}
+			}
+		}
+		rule = rule[:i]
+	}
+	if len(rule) > 1 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+		return "", exception, unsupportedRuleError{"Regular expressions are not supported"}
+	}
+	exact := false
+	if strings.HasPrefix(rule, "||") {
+		rule = rule[2:]
+	} else if strings.HasPrefix(rule, "|") {
+		rule = rule[1:]
+		exact = true
+	}
+	rule = strings.TrimSuffix(rule, "|")
+	rule = strings.TrimSuffix(rule, "^")
+	if strings.ContainsAny(rule, "/:?&") {
+		return "", exception, unsupportedRuleError{"Rules matching URLs are not supported"}
+	}
+	if len(rule) == 0 || strings.ContainsAny(rule, "^|@=[] \t") {
+		return "", exception, errors.New("Unexpected character")
+	}
+	pattern = strings.ToLower(rule)
+	if exact && !strings.Contains(pattern, "*") {
+		pattern = "=" + pattern
+	}
+	return pattern, exception, nil
+}
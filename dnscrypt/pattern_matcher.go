@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"unicode"
 
 	"github.com/k-sone/critbitgo"
 
@@ -28,6 +29,7 @@ type PatternMatcher struct {
 	blockedPatterns   []string
 	blockedExact      map[string]interface{}
 	indirectVals      map[string]interface{}
+	exceptions        *PatternMatcher
 }
 
 func NewPatternPatcher() *PatternMatcher {
@@ -159,3 +161,109 @@ func (patternMatcher *PatternMatcher) Eval(qName string) (reject bool, reason st
 
 	return false, "", nil
 }
+
+// EvalException tells whether a name matches an exception rule, written with the @@ prefix of the Adblock syntax
+func (patternMatcher *PatternMatcher) EvalException(qName string) (bool, string) {
+	if patternMatcher.exceptions == nil {
+		return false, ""
+	}
+	excepted, reason, _ := patternMatcher.exceptions.Eval(qName)
+	if excepted {
+		reason = "@@" + reason
+	}
+	return excepted, reason
+}
+
+// loadNamePatterns reads a list of name patterns, each of them optionally followed by @ and the name of a time range.
+// Hosts files and lists using the Adblock DNS syntax are also accepted, and their format is detected for every file.
+// Invalid rules are logged and skipped.
+func loadNamePatterns(fileName string, allWeeklyRanges *map[string]WeeklyRanges, rulesType string) (*PatternMatcher, rulesCount, error) {
+	var count rulesCount
+	bin, err := ReadTextFile(fileName)
+	if err != nil {
+		return nil, count, err
+	}
+	lines := strings.Split(string(bin), "\n")
+	format := detectNamePatternsFormat(lines)
+	if format != namePatternsFormatNative {
+		dlog.Infof("Reading %s from [%s] using the %s format", rulesType, fileName, namePatternsFormatNames[format])
+	}
+	patternMatcher := NewPatternPatcher()
+	var noWeeklyRanges *WeeklyRanges
+	for lineNo, line := range lines {
+		line = strings.TrimFunc(line, unicode.IsSpace)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if format == namePatternsFormatHosts || (format == namePatternsFormatAdblock && isHostsLine(line)) {
+			patterns, err := hostsLinePatterns(line)
+			if err != nil {
+				dlog.Errorf("Syntax error in %s at line %d -- %s", rulesType, 1+lineNo, err)
+				count.invalid++
+				continue
+			}
+			for _, pattern := range patterns {
+				if _, err := patternMatcher.Add(pattern, noWeeklyRanges, lineNo+1); err != nil {
+					dlog.Error(err)
+					count.invalid++
+					continue
+				}
+				count.valid++
+			}
+			continue
+		}
+		if format == namePatternsFormatAdblock {
+			pattern, exception, err := adblockRulePattern(line)
+			if _, unsupported := err.(unsupportedRuleError); unsupported {
+				dlog.Warnf("Ignoring rule [%s] in %s at line %d -- %s", line, rulesType, 1+lineNo, err)
+				continue
+			} else if err != nil {
+				dlog.Errorf("Syntax error in %s at line %d -- %s", rulesType, 1+lineNo, err)
+				count.invalid++
+				continue
+			} else if len(pattern) == 0 {
+				continue
+			}
+			target := patternMatcher
+			if exception {
+				if patternMatcher.exceptions == nil {
+					patternMatcher.exceptions = NewPatternPatcher()
+				}
+				target = patternMatcher.exceptions
+			}
+			if _, err := target.Add(pattern, noWeeklyRanges, lineNo+1); err != nil {
+				dlog.Error(err)
+				count.invalid++
+				continue
+			}
+			count.valid++
+			continue
+		}
+		parts := strings.Split(line, "@")
+		timeRangeName := ""
+		if len(parts) == 2 {
+			line = strings.TrimFunc(parts[0], unicode.IsSpace)
+			timeRangeName = strings.TrimFunc(parts[1], unicode.IsSpace)
+		} else if len(parts) > 2 {
+			dlog.Errorf("Syntax error in %s at line %d -- Unexpected @ character", rulesType, 1+lineNo)
+			count.invalid++
+			continue
+		}
+		var weeklyRanges *WeeklyRanges
+		if len(timeRangeName) > 0 {
+			weeklyRangesX, ok := (*allWeeklyRanges)[timeRangeName]
+			if !ok {
+				dlog.Errorf("Time range [%s] not found at line %d", timeRangeName, 1+lineNo)
+			} else {
+				weeklyRanges = &weeklyRangesX
+			}
+		}
+		if _, err := patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
+			dlog.Error(err)
+			count.invalid++
+			continue
+		}
+		count.valid++
+	}
+	return patternMatcher, count, nil
+}
@@ -1,24 +1,26 @@
 package dnscrypt
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
 
-	iradix "github.com/hashicorp/go-immutable-radix"
 	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 type PluginBlockIP struct {
-	blockedPrefixes *iradix.Tree
-	blockedIPs      map[string]interface{}
-	logger          *lumberjack.Logger
-	format          string
+	proxy       *Proxy
+	loadedRules int
+	blockedIPs  *IPTrie
+	logger      *lumberjack.Logger
+	format      string
 }
 
 func (plugin *PluginBlockIP) Name() string {
@@ -31,51 +33,125 @@ func (plugin *PluginBlockIP) Description() string {
 
 func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 	dlog.Noticef("Loading the set of IP blocking rules from [%s]", proxy.BlockIPFile)
-	bin, err := ReadTextFile(proxy.BlockIPFile)
+	plugin.proxy = proxy
+	blockedIPs, count, err := loadBlockedIPs(proxy.BlockIPFile)
 	if err != nil {
 		return err
 	}
-	plugin.blockedPrefixes = iradix.New()
-	plugin.blockedIPs = make(map[string]interface{})
+	if err := count.check(proxy.BlockIPFile); err != nil {
+		return err
+	}
+	plugin.blockedIPs = blockedIPs
+	plugin.loadedRules = count.valid
+	if len(proxy.BlockIPLogFile) == 0 {
+		return nil
+	}
+	plugin.logger = &lumberjack.Logger{LocalTime: true, MaxSize: proxy.LogMaxSize, MaxAge: proxy.LogMaxAge, MaxBackups: proxy.LogMaxBackups, Filename: proxy.BlockIPLogFile, Compress: true}
+	plugin.format = proxy.BlockIPFormat
+
+	return nil
+}
+
+// loadBlockedIPs loads rules made of IP addresses, networks in CIDR notation, ranges (start-end),
+// or prefixes ending at an octet or at a group, followed by a wildcard
+func loadBlockedIPs(fileName string) (*IPTrie, rulesCount, error) {
+	var count rulesCount
+	bin, err := ReadTextFile(fileName)
+	if err != nil {
+		return nil, count, err
+	}
+	blockedIPs := NewIPTrie()
 	for lineNo, line := range strings.Split(string(bin), "\n") {
 		line = strings.TrimFunc(line, unicode.IsSpace)
 		if len(line) == 0 || strings.HasPrefix(line, "#") {
 			continue
 		}
-		ip := net.ParseIP(line)
-		trailingStar := strings.HasSuffix(line, "*")
-		if len(line) < 2 || (ip != nil && trailingStar) {
-			dlog.Errorf("Suspicious IP blocking rule [%s] at line %d", line, lineNo)
-			continue
+		var err error
+		if strings.Contains(line, "/") {
+			var network *net.IPNet
+			if _, network, err = net.ParseCIDR(line); err == nil {
+				blockedIPs.Insert(network, nil)
+			}
+		} else if parts := strings.SplitN(line, "-", 2); len(parts) == 2 {
+			start, end := net.ParseIP(strings.TrimSpace(parts[0])), net.ParseIP(strings.TrimSpace(parts[1]))
+			if start == nil || end == nil {
+				err = errors.New("Invalid range")
+			} else {
+				err = blockedIPs.InsertRange(start, end, nil)
+			}
+		} else if strings.HasSuffix(line, "*") {
+			var networks []*net.IPNet
+			if networks, err = parseIPPrefixRule(line[:len(line)-1]); err == nil {
+				for _, network := range networks {
+					blockedIPs.Insert(network, nil)
+				}
+			}
+		} else if ip := net.ParseIP(line); ip != nil {
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			blockedIPs.Insert(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil)
+		} else {
+			err = errors.New("Not an IP address, a network or a range")
 		}
-		if trailingStar {
-			line = line[:len(line)-1]
+		if err != nil {
+			dlog.Errorf("Invalid IP blocking rule [%s] at line %d: %s", line, lineNo, err)
+			count.invalid++
+			continue
 		}
-		if strings.HasSuffix(line, ":") || strings.HasSuffix(line, ".") {
-			line = line[:len(line)-1]
+		count.valid++
+	}
+	return blockedIPs, count, nil
+}
+
+// parseIPPrefixRule returns the networks matching a prefix made of IPv4 octets or IPv6 groups.
+// A single number can be an IPv4 octet as well as an IPv6 group, and then matches both.
+func parseIPPrefixRule(prefix string) ([]*net.IPNet, error) {
+	prefix = strings.TrimRight(prefix, ".:")
+	if len(prefix) == 0 {
+		return nil, errors.New("Empty prefix")
+	}
+	if strings.ContainsAny(prefix, "*/") {
+		return nil, errors.New("Wildcards can only be used as a suffix")
+	}
+	var networks []*net.IPNet
+	if !strings.Contains(prefix, ":") {
+		octets := strings.Split(prefix, ".")
+		ip := make(net.IP, 4)
+		valid := len(octets) < 4
+		for i, octet := range octets {
+			value, err := strconv.ParseUint(octet, 10, 8)
+			if err != nil || !valid {
+				valid = false
+				break
+			}
+			ip[i] = byte(value)
 		}
-		if len(line) == 0 {
-			dlog.Errorf("Empty IP blocking rule at line %d", lineNo)
-			continue
+		if valid {
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(octets)*8, 32)})
 		}
-		if strings.Contains(line, "*") {
-			dlog.Errorf("Invalid rule: [%s] - wildcards can only be used as a suffix at line %d", line, lineNo)
-			continue
+	}
+	if !strings.Contains(prefix, ".") {
+		groups := strings.Split(prefix, ":")
+		ip := make(net.IP, 16)
+		valid := len(groups) < 8
+		for i, group := range groups {
+			value, err := strconv.ParseUint(group, 16, 16)
+			if err != nil || !valid {
+				valid = false
+				break
+			}
+			binary.BigEndian.PutUint16(ip[i*2:], uint16(value))
 		}
-		line = strings.ToLower(line)
-		if trailingStar {
-			plugin.blockedPrefixes, _, _ = plugin.blockedPrefixes.Insert([]byte(line), 0)
-		} else {
-			plugin.blockedIPs[line] = true
+		if valid {
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(groups)*16, 128)})
 		}
 	}
-	if len(proxy.BlockIPLogFile) == 0 {
-		return nil
+	if len(networks) == 0 {
+		return nil, errors.New("Invalid prefix")
 	}
-	plugin.logger = &lumberjack.Logger{LocalTime: true, MaxSize: proxy.LogMaxSize, MaxAge: proxy.LogMaxAge, MaxBackups: proxy.LogMaxBackups, Filename: proxy.BlockIPLogFile, Compress: true}
-	plugin.format = proxy.BlockIPFormat
-
-	return nil
+	return networks, nil
 }
 
 func (plugin *PluginBlockIP) Drop() error {
@@ -83,9 +159,31 @@ func (plugin *PluginBlockIP) Drop() error {
 }
 
 func (plugin *PluginBlockIP) Reload() error {
+	dlog.Noticef("Reloading the set of IP blocking rules from [%s]", plugin.proxy.BlockIPFile)
+	blockedIPs, count, err := loadBlockedIPs(plugin.proxy.BlockIPFile)
+	if err != nil {
+		return err
+	}
+	if err := count.check(plugin.proxy.BlockIPFile); err != nil {
+		return err
+	}
+	plugin.proxy.pluginsGlobals.Lock()
+	plugin.blockedIPs = blockedIPs
+	plugin.loadedRules = count.valid
+	plugin.proxy.pluginsGlobals.Unlock()
 	return nil
 }
 
+func (plugin *PluginBlockIP) loadedRulesCount() int {
+	plugin.proxy.pluginsGlobals.RLock()
+	defer plugin.proxy.pluginsGlobals.RUnlock()
+	return plugin.loadedRules
+}
+
+func (plugin *PluginBlockIP) rulesFile() string {
+	return plugin.proxy.BlockIPFile
+}
+
 func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	if pluginsState.sessionData["whitelisted"] != nil {
 		return nil
@@ -101,26 +199,21 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 		if header.Class != dns.ClassINET || (Rrtype != dns.TypeA && Rrtype != dns.TypeAAAA) {
 			continue
 		}
+		var ip net.IP
 		if Rrtype == dns.TypeA {
-			ipStr = answer.(*dns.A).A.String()
-		} else if Rrtype == dns.TypeAAAA {
-			ipStr = answer.(*dns.AAAA).AAAA.String() // IPv4-mapped IPv6 addresses are converted to IPv4
+			ip = answer.(*dns.A).A
+		} else {
+			ip = answer.(*dns.AAAA).AAAA
 		}
-		if _, found := plugin.blockedIPs[ipStr]; found {
-			reject, reason = true, ipStr
+		if network, _ := plugin.blockedIPs.Lookup(ip); network != nil {
+			reject, reason, ipStr = true, network.String(), ip.String() // IPv4-mapped IPv6 addresses are converted to IPv4
 			break
 		}
-		match, _, found := plugin.blockedPrefixes.Root().LongestPrefix([]byte(ipStr))
-		if found {
-			if len(match) == len(ipStr) || (ipStr[len(match)] == '.' || ipStr[len(match)] == ':') {
-				reject, reason = true, string(match)+"*"
-				break
-			}
-		}
 	}
 	if reject {
 		pluginsState.action = PluginsActionReject
 		pluginsState.returnCode = PluginsReturnCodeReject
+		pluginsState.blockedRule = reason
 		if plugin.logger != nil {
 			questions := msg.Question
 			if len(questions) != 1 {
@@ -145,6 +238,18 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 				line = fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n", tsStr, clientIPStr, StringQuote(qName), StringQuote(ipStr), StringQuote(reason))
 			} else if plugin.format == "ltsv" {
 				line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tip:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(ipStr), StringQuote(reason))
+			} else if plugin.format == "json" {
+				var err error
+				line, err = jsonLogLine(struct {
+					Time  time.Time `json:"time"`
+					Host  string    `json:"host"`
+					QName string    `json:"qname"`
+					IP    string    `json:"ip"`
+					Rule  string    `json:"rule"`
+				}{time.Now(), clientIPStr, qName, ipStr, reason})
+				if err != nil {
+					return err
+				}
 			} else {
 				dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 			}
@@ -3,10 +3,10 @@ package dnscrypt
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
@@ -14,8 +14,11 @@ import (
 )
 
 type PluginBlockName struct {
+	proxy           *Proxy
+	loadedRules     int
 	allWeeklyRanges *map[string]WeeklyRanges
 	patternMatcher  *PatternMatcher
+	groupMatchers   map[string]*PatternMatcher
 	logger          *lumberjack.Logger
 	format          string
 }
@@ -28,46 +31,35 @@ func (plugin *PluginBlockName) Description() string {
 	return "Block DNS queries matching name patterns"
 }
 
+func blockNameGroupFile(clientGroup *ClientGroup) string {
+	return clientGroup.BlockNameFile
+}
+
+func loadBlockNameGroupRules(clientGroup *ClientGroup, fileName string) (*PatternMatcher, rulesCount, error) {
+	return loadNamePatterns(fileName, clientGroup.AllWeeklyRanges, "block rules")
+}
+
 func (plugin *PluginBlockName) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of blocking rules from [%s]", proxy.BlockNameFile)
-	bin, err := ReadTextFile(proxy.BlockNameFile)
-	if err != nil {
-		return err
-	}
+	plugin.proxy = proxy
 	plugin.allWeeklyRanges = proxy.AllWeeklyRanges
-	plugin.patternMatcher = NewPatternPatcher()
-	for lineNo, line := range strings.Split(string(bin), "\n") {
-		line = strings.TrimFunc(line, unicode.IsSpace)
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
-			continue
-		}
-		parts := strings.Split(line, "@")
-		timeRangeName := ""
-		if len(parts) == 2 {
-			line = strings.TrimFunc(parts[0], unicode.IsSpace)
-			timeRangeName = strings.TrimFunc(parts[1], unicode.IsSpace)
-		} else if len(parts) > 2 {
-			dlog.Errorf("Syntax error in block rules at line %d -- Unexpected @ character", 1+lineNo)
-			continue
+	if len(proxy.BlockNameFile) > 0 {
+		dlog.Noticef("Loading the set of blocking rules from [%s]", proxy.BlockNameFile)
+		patternMatcher, count, err := loadNamePatterns(proxy.BlockNameFile, plugin.allWeeklyRanges, "block rules")
+		if err != nil {
+			return err
 		}
-		var weeklyRanges *WeeklyRanges
-		if len(timeRangeName) > 0 {
-			weeklyRangesX, ok := (*plugin.allWeeklyRanges)[timeRangeName]
-			if !ok {
-				dlog.Errorf("Time range [%s] not found at line %d", timeRangeName, 1+lineNo)
-			} else {
-				weeklyRanges = &weeklyRangesX
-			}
-		}
-		if _, err := plugin.patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
-			dlog.Error(err)
-			continue
+		if err := count.check(proxy.BlockNameFile); err != nil {
+			return err
 		}
+		plugin.patternMatcher = patternMatcher
+		plugin.loadedRules = count.valid
 	}
-	if len(proxy.BlockNameLogFile) == 0 {
-		return nil
+	groupMatchers, err := proxy.loadClientGroupsRules("blocking rules", blockNameGroupFile, loadBlockNameGroupRules)
+	if err != nil {
+		return err
 	}
-	plugin.logger = &lumberjack.Logger{LocalTime: true, MaxSize: proxy.LogMaxSize, MaxAge: proxy.LogMaxAge, MaxBackups: proxy.LogMaxBackups, Filename: proxy.BlockNameLogFile, Compress: true}
+	plugin.groupMatchers = groupMatchers
+	plugin.logger = proxy.blockNameLogger
 	plugin.format = proxy.BlockNameFormat
 
 	return nil
@@ -78,9 +70,45 @@ func (plugin *PluginBlockName) Drop() error {
 }
 
 func (plugin *PluginBlockName) Reload() error {
+	var patternMatcher *PatternMatcher
+	var count rulesCount
+	if len(plugin.proxy.BlockNameFile) > 0 {
+		dlog.Noticef("Reloading the set of blocking rules from [%s]", plugin.proxy.BlockNameFile)
+		var err error
+		patternMatcher, count, err = loadNamePatterns(plugin.proxy.BlockNameFile, plugin.allWeeklyRanges, "block rules")
+		if err != nil {
+			return err
+		}
+		if err := count.check(plugin.proxy.BlockNameFile); err != nil {
+			return err
+		}
+	}
+	groupMatchers, err := plugin.proxy.loadClientGroupsRules("blocking rules", blockNameGroupFile, loadBlockNameGroupRules)
+	if err != nil {
+		return err
+	}
+	plugin.proxy.pluginsGlobals.Lock()
+	plugin.patternMatcher = patternMatcher
+	plugin.groupMatchers = groupMatchers
+	plugin.loadedRules = count.valid
+	plugin.proxy.pluginsGlobals.Unlock()
 	return nil
 }
 
+func (plugin *PluginBlockName) loadedRulesCount() int {
+	plugin.proxy.pluginsGlobals.RLock()
+	defer plugin.proxy.pluginsGlobals.RUnlock()
+	return plugin.loadedRules
+}
+
+func (plugin *PluginBlockName) rulesFile() string {
+	return plugin.proxy.BlockNameFile
+}
+
+func (plugin *PluginBlockName) additionalRulesFiles() []string {
+	return plugin.proxy.clientGroupsFiles(blockNameGroupFile)
+}
+
 func (plugin *PluginBlockName) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	if pluginsState.sessionData["whitelisted"] != nil {
 		return nil
@@ -90,7 +118,32 @@ func (plugin *PluginBlockName) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 		return nil
 	}
 	qName := strings.ToLower(StripTrailingDot(questions[0].Name))
-	reject, reason, xweeklyRanges := plugin.patternMatcher.Eval(qName)
+	_, err := plugin.check(pluginsState, qName, "")
+	return err
+}
+
+// check rejects the query if a name matches the blocking rules of the client.
+// When the name is the target of a CNAME record of the response, it is given as cName, and qName is the name that was queried.
+func (plugin *PluginBlockName) check(pluginsState *PluginsState, qName string, cName string) (bool, error) {
+	patternMatcher := clientPatternMatcher(pluginsState, plugin.patternMatcher, plugin.groupMatchers)
+	if patternMatcher == nil {
+		return false, nil
+	}
+	name := qName
+	if len(cName) > 0 {
+		name = cName
+	}
+	if excepted, reason := patternMatcher.EvalException(name); excepted {
+		dlog.Debugf("Not blocking [%s] - Exception: [%s]", name, reason)
+		if len(cName) == 0 {
+			if pluginsState.sessionData == nil {
+				pluginsState.sessionData = make(map[string]interface{})
+			}
+			pluginsState.sessionData["whitelisted"] = true
+		}
+		return false, nil
+	}
+	reject, reason, xweeklyRanges := patternMatcher.Eval(name)
 	var weeklyRanges *WeeklyRanges
 	if xweeklyRanges != nil {
 		weeklyRanges = xweeklyRanges.(*WeeklyRanges)
@@ -100,32 +153,111 @@ func (plugin *PluginBlockName) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 			reject = false
 		}
 	}
-	if reject {
-		pluginsState.action = PluginsActionReject
-		pluginsState.returnCode = PluginsReturnCodeReject
-		if plugin.logger != nil {
-			var clientIPStr string
-			if pluginsState.clientProto == "udp" {
-				clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
-			} else {
-				clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
-			}
-			var line string
-			if plugin.format == "tsv" {
-				now := time.Now()
-				year, month, day := now.Date()
-				hour, minute, second := now.Clock()
-				tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
-				line = fmt.Sprintf("%s\t%s\t%s\t%s\n", tsStr, clientIPStr, StringQuote(qName), StringQuote(reason))
-			} else if plugin.format == "ltsv" {
-				line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(reason))
-			} else {
-				dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
-			}
-			if plugin.logger == nil {
-				return errors.New("Log file not initialized")
-			}
-			plugin.logger.Write([]byte(line))
+	if !reject {
+		return false, nil
+	}
+	pluginsState.action = PluginsActionReject
+	pluginsState.returnCode = PluginsReturnCodeReject
+	pluginsState.blockedRule = reason
+	if len(cName) > 0 {
+		dlog.Infof("Blocking [%s] via CNAME [%s] - Rule: [%s]", qName, cName, reason)
+	}
+	if plugin.logger == nil {
+		return true, nil
+	}
+	return true, logBlockedName(plugin.logger, plugin.format, pluginsState, qName, cName, reason)
+}
+
+// logBlockedName writes a line to the log of blocked names. cName is the CNAME target that matched, if any.
+func logBlockedName(logger io.Writer, format string, pluginsState *PluginsState, qName string, cName string, reason string) error {
+	var clientIPStr string
+	if pluginsState.clientProto == "udp" {
+		clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
+	} else {
+		clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
+	}
+	var line string
+	if format == "tsv" {
+		now := time.Now()
+		year, month, day := now.Date()
+		hour, minute, second := now.Clock()
+		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
+		line = fmt.Sprintf("%s\t%s\t%s\t%s", tsStr, clientIPStr, StringQuote(qName), StringQuote(reason))
+		if len(cName) > 0 {
+			line += fmt.Sprintf("\t%s", StringQuote(cName))
+		}
+		line += "\n"
+	} else if format == "ltsv" {
+		line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tmessage:%s", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(reason))
+		if len(cName) > 0 {
+			line += fmt.Sprintf("\tcname:%s", StringQuote(cName))
+		}
+		line += "\n"
+	} else if format == "json" {
+		var err error
+		line, err = jsonLogLine(struct {
+			Time  time.Time `json:"time"`
+			Host  string    `json:"host"`
+			QName string    `json:"qname"`
+			Rule  string    `json:"rule"`
+			CName string    `json:"cname,omitempty"`
+		}{time.Now(), clientIPStr, qName, reason, cName})
+		if err != nil {
+			return err
+		}
+	} else {
+		dlog.Fatalf("Unexpected log format: [%s]", format)
+	}
+	if logger == nil {
+		return errors.New("Log file not initialized")
+	}
+	logger.Write([]byte(line))
+	return nil
+}
+
+// PluginBlockNameResponse applies the blocking rules to the targets of the CNAME records of responses,
+// so that names hidden behind an alias of a name that isn't blocked get blocked too
+type PluginBlockNameResponse struct {
+	blockName *PluginBlockName
+}
+
+func (plugin *PluginBlockNameResponse) Name() string {
+	return "block_name_response"
+}
+
+func (plugin *PluginBlockNameResponse) Description() string {
+	return "Block DNS responses with CNAME targets matching name patterns"
+}
+
+func (plugin *PluginBlockNameResponse) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginBlockNameResponse) Drop() error {
+	return nil
+}
+
+func (plugin *PluginBlockNameResponse) Reload() error {
+	return nil
+}
+
+func (plugin *PluginBlockNameResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.sessionData["whitelisted"] != nil {
+		return nil
+	}
+	questions := msg.Question
+	if len(questions) != 1 {
+		return nil
+	}
+	qName := strings.ToLower(StripTrailingDot(questions[0].Name))
+	for _, answer := range msg.Answer {
+		header := answer.Header()
+		if header.Class != dns.ClassINET || header.Rrtype != dns.TypeCNAME {
+			continue
+		}
+		cName := strings.ToLower(StripTrailingDot(answer.(*dns.CNAME).Target))
+		if blocked, err := plugin.blockName.check(pluginsState, qName, cName); blocked || err != nil {
+			return err
 		}
 	}
 	return nil
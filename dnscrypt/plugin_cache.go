@@ -1,28 +1,162 @@
 package dnscrypt
 
 import (
+	"bytes"
 	"crypto/sha512"
 	"encoding/binary"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	lru "github.com/hashicorp/golang-lru"
+	"github.com/hashicorp/golang-lru/simplelru"
 	"github.com/miekg/dns"
 )
 
+const (
+	// CachePrefetchMinHits is the number of hits after which an entry is refreshed before it expires
+	CachePrefetchMinHits = 3
+	// CacheMaxShards is the maximum number of independently locked parts the cache is split into
+	CacheMaxShards = 64
+	// CacheMinShardSize is the minimum number of entries of a shard, so that small caches are not split
+	CacheMinShardSize = 32
+)
+
+// CachedResponse is a response kept in wire format, along with the offsets of its TTLs,
+// so that it can be served without being unpacked.
 type CachedResponse struct {
 	expiration time.Time
-	msg        dns.Msg
+	prefetchAt time.Time
+	hits       uint32
+	packet     []byte
+	ttlOffsets []uint16
+}
+
+func newCachedResponse(packet []byte, expiration time.Time, prefetchAt time.Time) (*CachedResponse, error) {
+	ttlOffsets, err := packetTTLOffsets(packet)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedResponse{
+		expiration: expiration,
+		prefetchAt: prefetchAt,
+		packet:     packet,
+		ttlOffsets: ttlOffsets,
+	}, nil
 }
 
+// response returns a copy of the cached packet, answering the query with the given TTL
+func (cached *CachedResponse) response(query *dns.Msg, ttl uint32) []byte {
+	packet := make([]byte, len(cached.packet))
+	copy(packet, cached.packet)
+	binary.BigEndian.PutUint16(packet[0:2], query.Id)
+	for _, offset := range cached.ttlOffsets {
+		binary.BigEndian.PutUint32(packet[offset:offset+4], ttl)
+	}
+	// The name of the question may only differ by its case, which has to be preserved
+	if len(query.Question) == 1 {
+		var name [256]byte
+		nameLen, err := dns.PackDomainName(query.Question[0].Name, name[:], 0, nil, false)
+		if err == nil && 12+nameLen <= len(packet) && bytes.EqualFold(packet[12:12+nameLen], name[:nameLen]) {
+			copy(packet[12:], name[:nameLen])
+		}
+	}
+	return packet
+}
+
+type cacheShard struct {
+	sync.Mutex
+	lru *simplelru.LRU
+}
+
+// CachedResponses is split into shards, selected by the cache key and locked independently,
+// so that concurrent queries rarely wait for each other.
 type CachedResponses struct {
-	sync.RWMutex
-	cache *lru.ARCCache
+	initOnce sync.Once
+	shards   []cacheShard
 }
 
 var cachedResponses CachedResponses
 
+var cachePrefetches sync.Map
+
+func (cache *CachedResponses) init(size int) {
+	cache.initOnce.Do(func() {
+		if size < 1 {
+			size = 1
+		}
+		shardsCount := 1
+		for shardsCount < CacheMaxShards && size/(shardsCount*2) >= CacheMinShardSize {
+			shardsCount *= 2
+		}
+		shards := make([]cacheShard, shardsCount)
+		for i := range shards {
+			shards[i].lru, _ = simplelru.NewLRU((size+shardsCount-1)/shardsCount, nil)
+		}
+		cache.shards = shards
+	})
+}
+
+func (cache *CachedResponses) shard(key [32]byte) *cacheShard {
+	return &cache.shards[binary.LittleEndian.Uint32(key[0:4])%uint32(len(cache.shards))]
+}
+
+func (cache *CachedResponses) get(key [32]byte) (*CachedResponse, bool) {
+	if len(cache.shards) == 0 {
+		return nil, false
+	}
+	shard := cache.shard(key)
+	shard.Lock()
+	cachedAny, ok := shard.lru.Get(key)
+	shard.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return cachedAny.(*CachedResponse), true
+}
+
+func (cache *CachedResponses) add(key [32]byte, cached *CachedResponse) {
+	if len(cache.shards) == 0 {
+		return
+	}
+	shard := cache.shard(key)
+	shard.Lock()
+	shard.lru.Add(key, cached)
+	shard.Unlock()
+}
+
+// forEach calls fn for every entry, from the least to the most recently used one of each shard.
+// Shards are only locked while their entries are being listed.
+func (cache *CachedResponses) forEach(fn func(key [32]byte, cached *CachedResponse)) {
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.Lock()
+		keys := shard.lru.Keys()
+		entries := make([]*CachedResponse, 0, len(keys))
+		for _, key := range keys {
+			cachedAny, _ := shard.lru.Peek(key)
+			entries = append(entries, cachedAny.(*CachedResponse))
+		}
+		shard.Unlock()
+		for j, cached := range entries {
+			fn(keys[j].([32]byte), cached)
+		}
+	}
+}
+
+// purge removes all the entries, and returns how many there were
+func (cache *CachedResponses) purge() int {
+	purged := 0
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.Lock()
+		purged += shard.lru.Len()
+		shard.lru.Purge()
+		shard.Unlock()
+	}
+	return purged
+}
+
 type PluginCacheResponse struct {
 	cachedResponses *CachedResponses
 }
@@ -36,6 +170,8 @@ func (plugin *PluginCacheResponse) Description() string {
 }
 
 func (plugin *PluginCacheResponse) Init(proxy *Proxy) error {
+	plugin.cachedResponses = &cachedResponses
+	plugin.cachedResponses.init(proxy.CacheSize)
 	return nil
 }
 
@@ -48,7 +184,6 @@ func (plugin *PluginCacheResponse) Reload() error {
 }
 
 func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
-	plugin.cachedResponses = &cachedResponses
 	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError && msg.Rcode != dns.RcodeNotAuth {
 		return nil
 	}
@@ -60,27 +195,27 @@ func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg
 		return err
 	}
 	ttl := getMinTTL(msg, pluginsState.cacheMinTTL, pluginsState.cacheMaxTTL, pluginsState.cacheNegMinTTL, pluginsState.cacheNegMaxTTL)
-	cachedResponse := CachedResponse{
-		expiration: time.Now().Add(ttl),
-		msg:        *msg,
-	}
-	plugin.cachedResponses.Lock()
-	if plugin.cachedResponses.cache == nil {
-		plugin.cachedResponses.cache, err = lru.NewARC(pluginsState.cacheSize)
-		if err != nil {
-			plugin.cachedResponses.Unlock()
-			return err
-		}
+	now := time.Now()
+	expiration := now.Add(ttl)
+	updateTTL(msg, expiration)
+	packed := *msg
+	packed.Compress = true
+	packet, err := packed.Pack()
+	if err != nil {
+		return err
+	}
+	cachedResponse, err := newCachedResponse(packet, expiration, now.Add(ttl-ttl/10))
+	if err != nil {
+		return err
 	}
-	plugin.cachedResponses.cache.Add(cacheKey, cachedResponse)
-	plugin.cachedResponses.Unlock()
-	updateTTL(msg, cachedResponse.expiration)
+	plugin.cachedResponses.add(cacheKey, cachedResponse)
 
 	return nil
 }
 
 type PluginCache struct {
 	cachedResponses *CachedResponses
+	proxy           *Proxy
 }
 
 func (plugin *PluginCache) Name() string {
@@ -92,6 +227,9 @@ func (plugin *PluginCache) Description() string {
 }
 
 func (plugin *PluginCache) Init(proxy *Proxy) error {
+	plugin.cachedResponses = &cachedResponses
+	plugin.cachedResponses.init(proxy.CacheSize)
+	plugin.proxy = proxy
 	return nil
 }
 
@@ -104,39 +242,70 @@ func (plugin *PluginCache) Reload() error {
 }
 
 func (plugin *PluginCache) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
-	plugin.cachedResponses = &cachedResponses
+	if pluginsState.cachePrefetch {
+		return nil
+	}
 
 	cacheKey, err := computeCacheKey(pluginsState, msg)
 	if err != nil {
 		return nil
 	}
-	plugin.cachedResponses.RLock()
-	defer plugin.cachedResponses.RUnlock()
-	if plugin.cachedResponses.cache == nil {
-		return nil
-	}
-	cachedAny, ok := plugin.cachedResponses.cache.Get(cacheKey)
+	cacheHit := false
+	defer func() { plugin.proxy.metrics.countCacheLookup(pluginsState.clientProto, cacheHit) }()
+	cached, ok := plugin.cachedResponses.get(cacheKey)
 	if !ok {
 		return nil
 	}
-	cached := cachedAny.(CachedResponse)
-	if time.Now().After(cached.expiration) {
+	now := time.Now()
+	if now.After(cached.expiration) {
+		staleMaxAge := time.Duration(plugin.proxy.CacheStaleMaxAge) * time.Second
+		if staleMaxAge > 0 && now.Sub(cached.expiration) <= staleMaxAge {
+			pluginsState.staleResponse = cached.response(msg, plugin.proxy.CacheStaleTTL)
+		}
 		return nil
 	}
+	cacheHit = true
+	if plugin.proxy.CachePrefetch && atomic.AddUint32(&cached.hits, 1) >= CachePrefetchMinHits &&
+		!cached.prefetchAt.IsZero() && now.After(cached.prefetchAt) {
+		if query, err := msg.Pack(); err == nil {
+			plugin.prefetch(cacheKey, query, pluginsState.clientGroup)
+		}
+	}
 
-	updateTTL(&cached.msg, cached.expiration)
-
-	synth := cached.msg
-	synth.Id = msg.Id
-	synth.Response = true
-	synth.Compress = true
-	synth.Question = msg.Question
-	pluginsState.synthResponse = &synth
+	ttl := uint32(cached.expiration.Sub(now) / time.Second)
+	pluginsState.synthPacket = cached.response(msg, ttl)
 	pluginsState.action = PluginsActionSynth
 	pluginsState.cacheHit = true
+	pluginsState.cacheTTL = ttl
 	return nil
 }
 
+// prefetch refreshes a cached response in the background, before it expires.
+// The query is resolved using the rules of the client group the response was cached for.
+func (plugin *PluginCache) prefetch(cacheKey [32]byte, query []byte, clientGroup *ClientGroup) {
+	if _, inProgress := cachePrefetches.LoadOrStore(cacheKey, true); inProgress {
+		return
+	}
+	proxy := plugin.proxy
+	proxy.lifecycleLock.Lock()
+	if proxy.stopping {
+		proxy.lifecycleLock.Unlock()
+		cachePrefetches.Delete(cacheKey)
+		return
+	}
+	proxy.inFlight.Add(1)
+	proxy.lifecycleLock.Unlock()
+	go func() {
+		defer proxy.inFlight.Done()
+		defer cachePrefetches.Delete(cacheKey)
+		clientAddr := exchangeClientAddr
+		pluginsState := NewPluginsState(proxy, "internal", &clientAddr, time.Now())
+		pluginsState.cachePrefetch = true
+		pluginsState.clientGroup = clientGroup
+		proxy.processQuery(&pluginsState, proxy.ServersInfo.getOne(), proxy.MainProto, query)
+	}()
+}
+
 func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) ([32]byte, error) {
 	questions := msg.Question
 	if len(questions) != 1 {
@@ -144,6 +313,11 @@ func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) ([32]byte, error)
 	}
 	question := questions[0]
 	h := sha512.New512_256()
+	// Clients of different groups may get different responses, that must not be shared
+	if clientGroup := pluginsState.clientGroup; clientGroup != nil {
+		h.Write([]byte{byte(len(clientGroup.Name))})
+		h.Write([]byte(clientGroup.Name))
+	}
 	var tmp [5]byte
 	binary.LittleEndian.PutUint16(tmp[0:2], question.Qtype)
 	binary.LittleEndian.PutUint16(tmp[2:4], question.Qclass)
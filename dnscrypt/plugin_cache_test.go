@@ -0,0 +1,91 @@
+package dnscrypt
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const benchmarkCacheSize = 4096
+
+// newBenchmarkCache returns a cache of a given size, split into a given number of shards
+func newBenchmarkCache(size int, shardsCount int) *CachedResponses {
+	cache := &CachedResponses{}
+	cache.initOnce.Do(func() {
+		cache.shards = make([]cacheShard, shardsCount)
+		for i := range cache.shards {
+			cache.shards[i].lru, _ = simplelru.NewLRU(size/shardsCount, nil)
+		}
+	})
+	return cache
+}
+
+func benchmarkCacheKeys(count int) [][32]byte {
+	keys := make([][32]byte, count)
+	for i := range keys {
+		var seed [8]byte
+		binary.LittleEndian.PutUint64(seed[:], uint64(i))
+		keys[i] = sha512.Sum512_256(seed[:])
+	}
+	return keys
+}
+
+// benchmarkCache runs parallel lookups, writePercent of the operations adding an entry instead.
+// Shards are not perfectly balanced, so that some lookups may miss entries evicted from full shards.
+func benchmarkCache(b *testing.B, cache *CachedResponses, writePercent uint64) {
+	keys := benchmarkCacheKeys(benchmarkCacheSize)
+	cached := &CachedResponse{expiration: time.Now().Add(time.Hour)}
+	for _, key := range keys {
+		cache.add(key, cached)
+	}
+	var seed uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddUint64(&seed, 1) * 7919
+		for pb.Next() {
+			i++
+			key := keys[i%uint64(len(keys))]
+			if i%100 < writePercent {
+				cache.add(key, cached)
+			} else {
+				cache.get(key)
+			}
+		}
+	})
+}
+
+func BenchmarkCacheGetSharded(b *testing.B) {
+	benchmarkCache(b, newBenchmarkCache(benchmarkCacheSize, CacheMaxShards), 0)
+}
+
+func BenchmarkCacheGetSingleShard(b *testing.B) {
+	benchmarkCache(b, newBenchmarkCache(benchmarkCacheSize, 1), 0)
+}
+
+func BenchmarkCacheAddSharded(b *testing.B) {
+	benchmarkCache(b, newBenchmarkCache(benchmarkCacheSize, CacheMaxShards), 100)
+}
+
+func BenchmarkCacheAddSingleShard(b *testing.B) {
+	benchmarkCache(b, newBenchmarkCache(benchmarkCacheSize, 1), 100)
+}
+
+func BenchmarkCacheMixedSharded(b *testing.B) {
+	benchmarkCache(b, newBenchmarkCache(benchmarkCacheSize, CacheMaxShards), 10)
+}
+
+func BenchmarkCacheMixedSingleShard(b *testing.B) {
+	benchmarkCache(b, newBenchmarkCache(benchmarkCacheSize, 1), 10)
+}
+
+func BenchmarkCacheWriteHeavySharded(b *testing.B) {
+	benchmarkCache(b, newBenchmarkCache(benchmarkCacheSize, CacheMaxShards), 50)
+}
+
+func BenchmarkCacheWriteHeavySingleShard(b *testing.B) {
+	benchmarkCache(b, newBenchmarkCache(benchmarkCacheSize, 1), 50)
+}
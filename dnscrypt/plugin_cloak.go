@@ -23,7 +23,10 @@ type CloakedName struct {
 
 type PluginCloak struct {
 	sync.RWMutex
+	proxy          *Proxy
+	loadedRules    int
 	patternMatcher *PatternMatcher
+	groupMatchers  map[string]*PatternMatcher
 	ttl            uint32
 }
 
@@ -35,14 +38,44 @@ func (plugin *PluginCloak) Description() string {
 	return "Return a synthetic IP address or a flattened CNAME for specific names"
 }
 
+func cloakGroupFile(clientGroup *ClientGroup) string {
+	return clientGroup.CloakFile
+}
+
+func loadCloakingGroupRules(clientGroup *ClientGroup, fileName string) (*PatternMatcher, rulesCount, error) {
+	return loadCloakingRules(fileName)
+}
+
 func (plugin *PluginCloak) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of cloaking rules from [%s]", proxy.CloakFile)
-	bin, err := ReadTextFile(proxy.CloakFile)
+	plugin.proxy = proxy
+	plugin.ttl = proxy.CloakTTL
+	if len(proxy.CloakFile) > 0 {
+		dlog.Noticef("Loading the set of cloaking rules from [%s]", proxy.CloakFile)
+		patternMatcher, count, err := loadCloakingRules(proxy.CloakFile)
+		if err != nil {
+			return err
+		}
+		if err := count.check(proxy.CloakFile); err != nil {
+			return err
+		}
+		plugin.patternMatcher = patternMatcher
+		plugin.loadedRules = count.valid
+	}
+	groupMatchers, err := proxy.loadClientGroupsRules("cloaking rules", cloakGroupFile, loadCloakingGroupRules)
 	if err != nil {
 		return err
 	}
-	plugin.ttl = proxy.CloakTTL
-	plugin.patternMatcher = NewPatternPatcher()
+	plugin.groupMatchers = groupMatchers
+	return nil
+}
+
+func loadCloakingRules(fileName string) (*PatternMatcher, rulesCount, error) {
+	var count rulesCount
+	bin, err := ReadTextFile(fileName)
+	if err != nil {
+		return nil, count, err
+	}
+	patternMatcher := NewPatternPatcher()
 	cloakedNames := make(map[string]*CloakedName)
 	for lineNo, line := range strings.Split(string(bin), "\n") {
 		line = strings.TrimFunc(line, unicode.IsSpace)
@@ -56,10 +89,12 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 			target = strings.TrimFunc(parts[1], unicode.IsSpace)
 		} else if len(parts) > 2 {
 			dlog.Errorf("Syntax error in cloaking rules at line %d -- Unexpected space character", 1+lineNo)
+			count.invalid++
 			continue
 		}
 		if len(line) == 0 || len(target) == 0 {
 			dlog.Errorf("Syntax error in cloaking rules at line %d -- Missing name or target", 1+lineNo)
+			count.invalid++
 			continue
 		}
 		line = strings.ToLower(line)
@@ -74,6 +109,7 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 				cloakedName.ipv6 = append((*cloakedName).ipv6, ipv6)
 			} else {
 				dlog.Errorf("Invalid IP address in cloaking rule at line %d", 1+lineNo)
+				count.invalid++
 				continue
 			}
 			cloakedName.isIP = true
@@ -82,11 +118,12 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 		}
 		cloakedName.lineNo = lineNo + 1
 		cloakedNames[line] = cloakedName
+		count.valid++
 	}
 	for line, cloakedName := range cloakedNames {
-		plugin.patternMatcher.Add(line, cloakedName, cloakedName.lineNo)
+		patternMatcher.Add(line, cloakedName, cloakedName.lineNo)
 	}
-	return nil
+	return patternMatcher, count, nil
 }
 
 func (plugin *PluginCloak) Drop() error {
@@ -94,9 +131,45 @@ func (plugin *PluginCloak) Drop() error {
 }
 
 func (plugin *PluginCloak) Reload() error {
+	var patternMatcher *PatternMatcher
+	var count rulesCount
+	if len(plugin.proxy.CloakFile) > 0 {
+		dlog.Noticef("Reloading the set of cloaking rules from [%s]", plugin.proxy.CloakFile)
+		var err error
+		patternMatcher, count, err = loadCloakingRules(plugin.proxy.CloakFile)
+		if err != nil {
+			return err
+		}
+		if err := count.check(plugin.proxy.CloakFile); err != nil {
+			return err
+		}
+	}
+	groupMatchers, err := plugin.proxy.loadClientGroupsRules("cloaking rules", cloakGroupFile, loadCloakingGroupRules)
+	if err != nil {
+		return err
+	}
+	plugin.proxy.pluginsGlobals.Lock()
+	plugin.patternMatcher = patternMatcher
+	plugin.groupMatchers = groupMatchers
+	plugin.loadedRules = count.valid
+	plugin.proxy.pluginsGlobals.Unlock()
 	return nil
 }
 
+func (plugin *PluginCloak) loadedRulesCount() int {
+	plugin.proxy.pluginsGlobals.RLock()
+	defer plugin.proxy.pluginsGlobals.RUnlock()
+	return plugin.loadedRules
+}
+
+func (plugin *PluginCloak) rulesFile() string {
+	return plugin.proxy.CloakFile
+}
+
+func (plugin *PluginCloak) additionalRulesFiles() []string {
+	return plugin.proxy.clientGroupsFiles(cloakGroupFile)
+}
+
 func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	questions := msg.Question
 	if len(questions) != 1 {
@@ -110,9 +183,13 @@ func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 	if len(qName) < 2 {
 		return nil
 	}
+	patternMatcher := clientPatternMatcher(pluginsState, plugin.patternMatcher, plugin.groupMatchers)
+	if patternMatcher == nil {
+		return nil
+	}
 	now := time.Now()
 	plugin.RLock()
-	_, _, xcloakedName := plugin.patternMatcher.Eval(qName)
+	_, _, xcloakedName := patternMatcher.Eval(qName)
 	if xcloakedName == nil {
 		plugin.RUnlock()
 		return nil
@@ -0,0 +1,176 @@
+package dnscrypt
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+// exchangedMessages keeps copies of the packets exchanged for a query, for plugins logging them verbatim
+type exchangedMessages struct {
+	clientQuery        []byte
+	clientResponse     []byte
+	serverAddr         net.Addr
+	serverProtocol     uint64
+	serverQuery        []byte
+	serverQueryTime    time.Time
+	serverResponse     []byte
+	serverResponseTime time.Time
+}
+
+func (messages *exchangedMessages) setClientQuery(query []byte) {
+	if messages == nil {
+		return
+	}
+	messages.clientQuery = append([]byte{}, query...)
+}
+
+func (messages *exchangedMessages) setClientResponse(response []byte) {
+	if messages == nil {
+		return
+	}
+	messages.clientResponse = response
+}
+
+func (messages *exchangedMessages) setServerQuery(serverInfo *ServerInfo, serverProto string, query []byte, start time.Time) {
+	if messages == nil {
+		return
+	}
+	messages.serverQuery = append([]byte{}, query...)
+	messages.serverQueryTime = start
+	messages.serverAddr, messages.serverProtocol = dnstapServerAddrAndProtocol(serverInfo, serverProto)
+}
+
+func (messages *exchangedMessages) setServerResponse(serverInfo *ServerInfo, serverProto string, response []byte, end time.Time) {
+	if messages == nil {
+		return
+	}
+	messages.serverResponse = append([]byte{}, response...)
+	messages.serverResponseTime = end
+	messages.serverAddr, messages.serverProtocol = dnstapServerAddrAndProtocol(serverInfo, serverProto)
+}
+
+func dnstapServerAddrAndProtocol(serverInfo *ServerInfo, serverProto string) (net.Addr, uint64) {
+	switch serverInfo.Proto {
+	case stamps.StampProtoTypeDNSCrypt:
+		if serverProto == "tcp" {
+			return serverInfo.TCPAddr, dnstapProtocolDNSCryptTCP
+		}
+		return serverInfo.UDPAddr, dnstapProtocolDNSCryptUDP
+	case stamps.StampProtoTypePlain:
+		if serverProto == "tcp" {
+			return serverInfo.TCPAddr, dnstapProtocolTCP
+		}
+		return serverInfo.UDPAddr, dnstapProtocolUDP
+	case stamps.StampProtoTypeTLS:
+		return serverInfo.TCPAddr, dnstapProtocolDoT
+	case stamps.StampProtoTypeDoH, StampProtoTypeODoHTarget:
+		return nil, dnstapProtocolDoH
+	}
+	return nil, 0
+}
+
+var dnstapClientProtocols = map[string]uint64{
+	"udp": dnstapProtocolUDP,
+	"tcp": dnstapProtocolTCP,
+	"dot": dnstapProtocolDoT,
+	"doh": dnstapProtocolDoH,
+}
+
+type PluginDnstap struct {
+	writer   *dnstapWriter
+	identity []byte
+	version  []byte
+}
+
+func (plugin *PluginDnstap) Name() string {
+	return "dnstap"
+}
+
+func (plugin *PluginDnstap) Description() string {
+	return "Log queries and responses using dnstap."
+}
+
+func (plugin *PluginDnstap) Init(proxy *Proxy) error {
+	identity := proxy.DnstapIdentity
+	if len(identity) == 0 {
+		identity, _ = os.Hostname()
+	}
+	plugin.identity = []byte(identity)
+	plugin.version = []byte("dnscrypt-proxy")
+	plugin.writer = newDnstapWriter(proxy.DnstapNetwork, proxy.DnstapAddress, proxy.Timeout)
+	if !proxy.addCloser(plugin.writer.Close) {
+		return nil
+	}
+	proxy.keepExchangedMessages = true
+	dlog.Noticef("dnstap output: [%s]", proxy.DnstapAddress)
+	return nil
+}
+
+func (plugin *PluginDnstap) Drop() error {
+	return plugin.writer.Close(context.Background())
+}
+
+func (plugin *PluginDnstap) Reload() error {
+	return nil
+}
+
+func (plugin *PluginDnstap) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	messages := pluginsState.messages
+	if messages == nil {
+		return nil
+	}
+	var clientAddr net.Addr
+	if pluginsState.clientAddr != nil && pluginsState.clientProto != "internal" {
+		clientAddr = *pluginsState.clientAddr
+	}
+	clientProtocol := dnstapClientProtocols[pluginsState.clientProto]
+	if len(messages.clientQuery) > 0 {
+		plugin.write(&dnstapMessage{
+			messageType:    dnstapClientQuery,
+			socketProtocol: clientProtocol,
+			queryAddr:      clientAddr,
+			queryTime:      pluginsState.requestStart,
+			queryMessage:   messages.clientQuery,
+		})
+	}
+	if len(messages.serverQuery) > 0 {
+		plugin.write(&dnstapMessage{
+			messageType:    dnstapForwarderQuery,
+			socketProtocol: messages.serverProtocol,
+			responseAddr:   messages.serverAddr,
+			queryTime:      messages.serverQueryTime,
+			queryMessage:   messages.serverQuery,
+		})
+		if len(messages.serverResponse) > 0 {
+			plugin.write(&dnstapMessage{
+				messageType:     dnstapForwarderResponse,
+				socketProtocol:  messages.serverProtocol,
+				responseAddr:    messages.serverAddr,
+				queryTime:       messages.serverQueryTime,
+				responseTime:    messages.serverResponseTime,
+				responseMessage: messages.serverResponse,
+			})
+		}
+	}
+	if len(messages.clientResponse) > 0 {
+		plugin.write(&dnstapMessage{
+			messageType:     dnstapClientResponse,
+			socketProtocol:  clientProtocol,
+			queryAddr:       clientAddr,
+			queryTime:       pluginsState.requestStart,
+			responseTime:    pluginsState.requestEnd,
+			responseMessage: messages.clientResponse,
+		})
+	}
+	return nil
+}
+
+func (plugin *PluginDnstap) write(message *dnstapMessage) {
+	plugin.writer.write(encodeDnstapFrame(plugin.identity, plugin.version, message))
+}
@@ -17,7 +17,9 @@ type PluginForwardEntry struct {
 }
 
 type PluginForward struct {
-	forwardMap []PluginForwardEntry
+	proxy       *Proxy
+	loadedRules int
+	forwardMap  []PluginForwardEntry
 }
 
 func (plugin *PluginForward) Name() string {
@@ -30,10 +32,22 @@ func (plugin *PluginForward) Description() string {
 
 func (plugin *PluginForward) Init(proxy *Proxy) error {
 	dlog.Noticef("Loading the set of forwarding rules from [%s]", proxy.ForwardFile)
-	bin, err := ReadTextFile(proxy.ForwardFile)
+	plugin.proxy = proxy
+	forwardMap, err := loadForwardingRules(proxy.ForwardFile)
 	if err != nil {
 		return err
 	}
+	plugin.forwardMap = forwardMap
+	plugin.loadedRules = len(forwardMap)
+	return nil
+}
+
+func loadForwardingRules(fileName string) ([]PluginForwardEntry, error) {
+	bin, err := ReadTextFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var forwardMap []PluginForwardEntry
 	for lineNo, line := range strings.Split(string(bin), "\n") {
 		line = strings.TrimFunc(line, unicode.IsSpace)
 		if len(line) == 0 || strings.HasPrefix(line, "#") {
@@ -41,7 +55,7 @@ func (plugin *PluginForward) Init(proxy *Proxy) error {
 		}
 		domain, serversStr, ok := StringTwoFields(line)
 		if !ok {
-			return fmt.Errorf("Syntax error for a forwarding rule at line %d. Expected syntax: example.com: 9.9.9.9,8.8.8.8", 1+lineNo)
+			return nil, fmt.Errorf("Syntax error for a forwarding rule at line %d. Expected syntax: example.com: 9.9.9.9,8.8.8.8", 1+lineNo)
 		}
 		domain = strings.ToLower(domain)
 		var servers []string
@@ -55,11 +69,11 @@ func (plugin *PluginForward) Init(proxy *Proxy) error {
 		if len(servers) == 0 {
 			continue
 		}
-		plugin.forwardMap = append(plugin.forwardMap, PluginForwardEntry{
+		forwardMap = append(forwardMap, PluginForwardEntry{
 			domain: domain, servers: servers,
 		})
 	}
-	return nil
+	return forwardMap, nil
 }
 
 func (plugin *PluginForward) Drop() error {
@@ -67,9 +81,29 @@ func (plugin *PluginForward) Drop() error {
 }
 
 func (plugin *PluginForward) Reload() error {
+	dlog.Noticef("Reloading the set of forwarding rules from [%s]", plugin.proxy.ForwardFile)
+	forwardMap, err := loadForwardingRules(plugin.proxy.ForwardFile)
+	if err != nil {
+		return err
+	}
+	dlog.Noticef("%d rules loaded from [%s]", len(forwardMap), plugin.proxy.ForwardFile)
+	plugin.proxy.pluginsGlobals.Lock()
+	plugin.forwardMap = forwardMap
+	plugin.loadedRules = len(forwardMap)
+	plugin.proxy.pluginsGlobals.Unlock()
 	return nil
 }
 
+func (plugin *PluginForward) loadedRulesCount() int {
+	plugin.proxy.pluginsGlobals.RLock()
+	defer plugin.proxy.pluginsGlobals.RUnlock()
+	return plugin.loadedRules
+}
+
+func (plugin *PluginForward) rulesFile() string {
+	return plugin.proxy.ForwardFile
+}
+
 func (plugin *PluginForward) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	questions := msg.Question
 	if len(questions) != 1 {
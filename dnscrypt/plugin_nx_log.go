@@ -70,6 +70,17 @@ func (plugin *PluginNxLog) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 	} else if plugin.format == "ltsv" {
 		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s\n",
 			time.Now().Unix(), clientIPStr, StringQuote(qName), qType)
+	} else if plugin.format == "json" {
+		var err error
+		line, err = jsonLogLine(struct {
+			Time  time.Time `json:"time"`
+			Host  string    `json:"host"`
+			QName string    `json:"qname"`
+			QType string    `json:"qtype"`
+		}{time.Now(), clientIPStr, qName, qType})
+		if err != nil {
+			return err
+		}
 	} else {
 		dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 	}
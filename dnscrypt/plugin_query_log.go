@@ -12,6 +12,25 @@ import (
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 )
 
+type queryLogJSONEntry struct {
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host"`
+	QName       string    `json:"qname"`
+	QType       string    `json:"qtype"`
+	Return      string    `json:"return"`
+	Cached      bool      `json:"cached"`
+	CacheTTL    *uint32   `json:"cache_ttl,omitempty"`
+	Duration    float64   `json:"duration_ms"`
+	ServerRTT   *float64  `json:"server_rtt_ms,omitempty"`
+	Server      string    `json:"server"`
+	Proto       string    `json:"proto"`
+	DNSSEC      bool      `json:"dnssec_ok"`
+	Rcode       string    `json:"rcode,omitempty"`
+	Answers     []string  `json:"answers,omitempty"`
+	IPs         []string  `json:"ips,omitempty"`
+	BlockedRule string    `json:"blocked_rule,omitempty"`
+}
+
 type PluginQueryLog struct {
 	logger        *lumberjack.Logger
 	format        string
@@ -97,8 +116,56 @@ func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) err
 		if pluginsState.cacheHit {
 			cached = 1
 		}
-		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s\treturn:%s\tcached:%d\tduration:%d\tserver:%s\n",
-			time.Now().Unix(), clientIPStr, StringQuote(qName), qType, returnCode, cached, requestDuration/time.Millisecond, StringQuote(pluginsState.serverName))
+		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s\treturn:%s\tcached:%d\tduration:%d\tserver:%s\tproto:%s\n",
+			time.Now().Unix(), clientIPStr, StringQuote(qName), qType, returnCode, cached, requestDuration/time.Millisecond, StringQuote(pluginsState.serverName), pluginsState.clientProto)
+	} else if plugin.format == "json" {
+		entry := queryLogJSONEntry{
+			Time:        time.Now(),
+			Host:        clientIPStr,
+			QName:       qName,
+			QType:       qType,
+			Return:      returnCode,
+			Cached:      pluginsState.cacheHit,
+			Duration:    float64(requestDuration) / float64(time.Millisecond),
+			Server:      pluginsState.serverName,
+			Proto:       pluginsState.clientProto,
+			DNSSEC:      pluginsState.dnssec,
+			BlockedRule: pluginsState.blockedRule,
+		}
+		if pluginsState.cacheHit {
+			entry.CacheTTL = &pluginsState.cacheTTL
+		}
+		if pluginsState.serverRtt > 0 {
+			serverRtt := float64(pluginsState.serverRtt) / float64(time.Millisecond)
+			entry.ServerRTT = &serverRtt
+		}
+		// Responses rejected by response plugins are replaced with the synthetic response sent to the client
+		response := pluginsState.responseMsg
+		if pluginsState.synthResponse != nil || pluginsState.returnCode == PluginsReturnCodeReject {
+			response = pluginsState.synthResponse
+		}
+		if response == nil && pluginsState.synthPacket != nil {
+			var synthMsg dns.Msg
+			if synthMsg.Unpack(pluginsState.synthPacket) == nil {
+				response = &synthMsg
+			}
+		}
+		if response != nil {
+			entry.Rcode = dns.RcodeToString[response.Rcode]
+			for _, answer := range response.Answer {
+				entry.Answers = append(entry.Answers, answer.String())
+				switch rr := answer.(type) {
+				case *dns.A:
+					entry.IPs = append(entry.IPs, rr.A.String())
+				case *dns.AAAA:
+					entry.IPs = append(entry.IPs, rr.AAAA.String())
+				}
+			}
+		}
+		var err error
+		if line, err = jsonLogLine(entry); err != nil {
+			return err
+		}
 	} else {
 		dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 	}
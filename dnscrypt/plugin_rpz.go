@@ -0,0 +1,471 @@
+package dnscrypt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+type rpzAction int
+
+const (
+	rpzActionNXDomain rpzAction = iota
+	rpzActionNoData
+	rpzActionPassthru
+	rpzActionDrop
+	rpzActionLocalData
+)
+
+var rpzActionNames = map[rpzAction]string{
+	rpzActionNXDomain:  "NXDOMAIN",
+	rpzActionNoData:    "NODATA",
+	rpzActionPassthru:  "PASSTHRU",
+	rpzActionDrop:      "DROP",
+	rpzActionLocalData: "LOCAL-DATA",
+}
+
+// rpzRule is the policy of a trigger: an action, or the records to respond with
+type rpzRule struct {
+	owner     string
+	action    rpzAction
+	localData []dns.RR
+}
+
+// rpzNames are name triggers. Wildcards are indexed by the name they are prepended to.
+type rpzNames struct {
+	exact     map[string]*rpzRule
+	wildcards map[string]*rpzRule
+}
+
+func newRPZNames() rpzNames {
+	return rpzNames{exact: make(map[string]*rpzRule), wildcards: make(map[string]*rpzRule)}
+}
+
+func (names *rpzNames) add(trigger string, rule *rpzRule) {
+	if trigger == "*" {
+		names.wildcards[""] = rule
+	} else if strings.HasPrefix(trigger, "*.") {
+		names.wildcards[trigger[2:]] = rule
+	} else {
+		names.exact[trigger] = rule
+	}
+}
+
+// match returns the rule of a name, an exact match taking precedence over the most specific wildcard
+func (names *rpzNames) match(name string) *rpzRule {
+	if rule, found := names.exact[name]; found {
+		return rule
+	}
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+		if rule, found := names.wildcards[name]; found {
+			return rule
+		}
+	}
+	return names.wildcards[""]
+}
+
+// rpzZone is a Response Policy Zone. QNAME triggers apply to queries, RPZ-IP and RPZ-NSDNAME triggers to responses.
+type rpzZone struct {
+	name     string
+	qNames   rpzNames
+	ips      *IPTrie
+	nsdNames rpzNames
+}
+
+type PluginRPZ struct {
+	proxy       *Proxy
+	loadedRules int
+	zones       []*rpzZone
+	logger      *lumberjack.Logger
+	format      string
+}
+
+func (plugin *PluginRPZ) Name() string {
+	return "rpz"
+}
+
+func (plugin *PluginRPZ) Description() string {
+	return "Apply the policies of Response Policy Zones"
+}
+
+func (plugin *PluginRPZ) Init(proxy *Proxy) error {
+	plugin.proxy = proxy
+	zones, count, err := loadRPZZones(proxy.RPZZoneFiles)
+	if err != nil {
+		return err
+	}
+	plugin.zones = zones
+	plugin.loadedRules = count.valid
+	plugin.logger = proxy.blockNameLogger
+	plugin.format = proxy.BlockNameFormat
+	return nil
+}
+
+func (plugin *PluginRPZ) Drop() error {
+	return nil
+}
+
+func (plugin *PluginRPZ) Reload() error {
+	zones, count, err := loadRPZZones(plugin.proxy.RPZZoneFiles)
+	if err != nil {
+		return err
+	}
+	plugin.proxy.pluginsGlobals.Lock()
+	plugin.zones = zones
+	plugin.loadedRules = count.valid
+	plugin.proxy.pluginsGlobals.Unlock()
+	return nil
+}
+
+func (plugin *PluginRPZ) loadedRulesCount() int {
+	plugin.proxy.pluginsGlobals.RLock()
+	defer plugin.proxy.pluginsGlobals.RUnlock()
+	return plugin.loadedRules
+}
+
+func (plugin *PluginRPZ) rulesFile() string {
+	return plugin.proxy.RPZZoneFiles[0]
+}
+
+func (plugin *PluginRPZ) additionalRulesFiles() []string {
+	return plugin.proxy.RPZZoneFiles[1:]
+}
+
+// loadRPZZones loads zone files, from the highest precedence to the lowest.
+// A zone only made of invalid rules causes an error, so that the previous zones can be kept when reloading.
+func loadRPZZones(fileNames []string) ([]*rpzZone, rulesCount, error) {
+	var zones []*rpzZone
+	var total rulesCount
+	for _, fileName := range fileNames {
+		dlog.Noticef("Loading the response policy zone from [%s]", fileName)
+		zone, count, err := loadRPZZone(fileName)
+		if err != nil {
+			return nil, total, err
+		}
+		if err := count.check(fileName); err != nil {
+			return nil, total, err
+		}
+		zones = append(zones, zone)
+		total.valid += count.valid
+		total.invalid += count.invalid
+	}
+	return zones, total, nil
+}
+
+// loadRPZZone loads a zone file, whose first record must be the SOA record of the zone.
+// Triggers that can't be evaluated by a forwarder, such as RPZ-NSIP and RPZ-CLIENT-IP, are ignored.
+func loadRPZZone(fileName string) (*rpzZone, rulesCount, error) {
+	var count rulesCount
+	bin, err := ReadTextFile(fileName)
+	if err != nil {
+		return nil, count, err
+	}
+	zoneParser := dns.NewZoneParser(strings.NewReader(bin), ".", fileName)
+	zoneParser.SetIncludeAllowed(false)
+	apex := ""
+	var owners []string
+	rules := make(map[string]*rpzRule)
+	invalidOwners := make(map[string]bool)
+	for rr, ok := zoneParser.Next(); ok; rr, ok = zoneParser.Next() {
+		header := rr.Header()
+		owner := strings.ToLower(header.Name)
+		if header.Rrtype == dns.TypeSOA {
+			if len(apex) == 0 {
+				apex = owner
+			}
+			continue
+		}
+		if len(apex) == 0 {
+			return nil, count, errors.New("The zone doesn't start with a SOA record")
+		}
+		if owner == apex || !dns.IsSubDomain(apex, owner) || invalidOwners[owner] {
+			if owner != apex {
+				dlog.Errorf("Invalid policy record [%s] in [%s]: not in zone [%s]", owner, fileName, apex)
+				count.invalid++
+			}
+			continue
+		}
+		rule, found := rules[owner]
+		if !found {
+			rule = &rpzRule{owner: StripTrailingDot(owner), action: rpzActionLocalData}
+		}
+		if err := rule.addRecord(rr); err != nil {
+			dlog.Errorf("Invalid policy record [%s] in [%s]: %s", owner, fileName, err)
+			count.invalid++
+			invalidOwners[owner] = true
+			delete(rules, owner)
+			continue
+		}
+		if !found {
+			owners = append(owners, owner)
+			rules[owner] = rule
+		}
+	}
+	if err := zoneParser.Err(); err != nil {
+		return nil, count, err
+	}
+	if len(apex) == 0 {
+		return nil, count, errors.New("No SOA record found")
+	}
+	zone := &rpzZone{name: StripTrailingDot(apex), qNames: newRPZNames(), ips: NewIPTrie(), nsdNames: newRPZNames()}
+	ignored := 0
+	for _, owner := range owners {
+		rule, found := rules[owner]
+		if !found {
+			continue
+		}
+		trigger := strings.TrimSuffix(strings.TrimSuffix(owner, apex), ".")
+		labels := strings.Split(trigger, ".")
+		switch labels[len(labels)-1] {
+		case "rpz-ip":
+			network, err := parseRPZIPTrigger(labels[:len(labels)-1])
+			if err != nil {
+				dlog.Errorf("Invalid RPZ-IP trigger [%s] in [%s]: %s", owner, fileName, err)
+				count.invalid++
+				continue
+			}
+			zone.ips.Insert(network, rule)
+		case "rpz-nsdname":
+			zone.nsdNames.add(strings.TrimSuffix(trigger, ".rpz-nsdname"), rule)
+		case "rpz-nsip", "rpz-client-ip":
+			ignored++
+			continue
+		default:
+			zone.qNames.add(trigger, rule)
+		}
+		count.valid++
+	}
+	if ignored > 0 {
+		dlog.Noticef("%d unsupported triggers ignored in [%s]", ignored, fileName)
+	}
+	return zone, count, nil
+}
+
+// addRecord sets the action of a rule, or adds a record to its local data.
+// Actions are encoded as CNAME records: `.` for NXDOMAIN, `*.` for NODATA, `rpz-passthru.` and `rpz-drop.`
+func (rule *rpzRule) addRecord(rr dns.RR) error {
+	action := rpzActionLocalData
+	if cname, ok := rr.(*dns.CNAME); ok {
+		switch target := strings.ToLower(cname.Target); target {
+		case ".":
+			action = rpzActionNXDomain
+		case "*.":
+			action = rpzActionNoData
+		case "rpz-passthru.":
+			action = rpzActionPassthru
+		case "rpz-drop.":
+			action = rpzActionDrop
+		default:
+			if strings.HasPrefix(target, "rpz-") || strings.HasPrefix(target, "*.") {
+				return fmt.Errorf("Unsupported action [%s]", target)
+			}
+		}
+	}
+	if action != rpzActionLocalData || rule.action != rpzActionLocalData {
+		if rule.action != rpzActionLocalData || len(rule.localData) > 0 {
+			return errors.New("An action cannot be combined with other records")
+		}
+		rule.action = action
+		return nil
+	}
+	rule.localData = append(rule.localData, rr)
+	return nil
+}
+
+// parseRPZIPTrigger parses the labels of an RPZ-IP trigger: the prefix length, followed by the address in reverse order.
+// IPv6 addresses use `zz` for the longest run of zeros.
+func parseRPZIPTrigger(labels []string) (*net.IPNet, error) {
+	if len(labels) < 2 {
+		return nil, errors.New("Missing address")
+	}
+	prefixLen, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, errors.New("Invalid prefix length")
+	}
+	parts := make([]string, len(labels)-1)
+	for i, label := range labels[1:] {
+		parts[len(parts)-1-i] = label
+	}
+	bits := 32
+	ipStr := strings.Join(parts, ".")
+	if len(parts) != 4 || strings.Contains(ipStr, "zz") {
+		bits = 128
+		ipStr = ":" + strings.Join(parts, ":") + ":"
+		ipStr = strings.Replace(ipStr, ":zz:", "::", 1)
+		ipStr = strings.TrimPrefix(strings.TrimSuffix(ipStr, ":"), ":")
+		if strings.HasPrefix(ipStr, ":") {
+			ipStr = ":" + ipStr
+		}
+		if strings.HasSuffix(ipStr, ":") {
+			ipStr += ":"
+		}
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil || (bits == 32) != (ip.To4() != nil) {
+		return nil, errors.New("Invalid address")
+	}
+	if bits == 32 {
+		ip = ip.To4()
+	}
+	if prefixLen < 1 || prefixLen > bits {
+		return nil, errors.New("Invalid prefix length")
+	}
+	mask := net.CIDRMask(prefixLen, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+func (plugin *PluginRPZ) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.sessionData["whitelisted"] != nil {
+		return nil
+	}
+	questions := msg.Question
+	if len(questions) != 1 || questions[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	qName := strings.ToLower(StripTrailingDot(questions[0].Name))
+	for _, zone := range plugin.zones {
+		if rule := zone.qNames.match(qName); rule != nil {
+			return plugin.apply(pluginsState, msg, zone, rule, qName)
+		}
+	}
+	return nil
+}
+
+// apply enforces the policy of a rule, matched in a query, or in a response if msg is a response
+func (plugin *PluginRPZ) apply(pluginsState *PluginsState, msg *dns.Msg, zone *rpzZone, rule *rpzRule, qName string) error {
+	if rule.action == rpzActionPassthru {
+		if pluginsState.sessionData == nil {
+			pluginsState.sessionData = make(map[string]interface{})
+		}
+		pluginsState.sessionData["rpz_passthru"] = true
+		return nil
+	}
+	reason := fmt.Sprintf("%s (%s)", rule.owner, rpzActionNames[rule.action])
+	pluginsState.returnCode = PluginsReturnCodeReject
+	pluginsState.blockedRule = reason
+	if rule.action == rpzActionDrop {
+		pluginsState.action = PluginsActionDrop
+	} else {
+		question := msg.Question[0]
+		synth, err := EmptyResponseFromMessage(msg)
+		if err != nil {
+			return err
+		}
+		synth.Rcode = dns.RcodeSuccess
+		synth.AuthenticatedData = false
+		switch rule.action {
+		case rpzActionNXDomain:
+			synth.Rcode = dns.RcodeNameError
+		case rpzActionLocalData:
+			for _, rr := range rule.localData {
+				if rrType := rr.Header().Rrtype; rrType == question.Qtype || rrType == dns.TypeCNAME || question.Qtype == dns.TypeANY {
+					rr = dns.Copy(rr)
+					rr.Header().Name = question.Name
+					synth.Answer = append(synth.Answer, rr)
+				}
+			}
+			if cname, ok := answerCNAME(synth.Answer); ok && !pluginsState.cnameChase &&
+				question.Qtype != dns.TypeCNAME && question.Qtype != dns.TypeANY {
+				pluginsState.cnameTarget = cname.Target
+			}
+		}
+		pluginsState.action = PluginsActionSynth
+		pluginsState.synthResponse = synth
+	}
+	if plugin.logger == nil {
+		return nil
+	}
+	return logBlockedName(plugin.logger, plugin.format, pluginsState, qName, "", reason)
+}
+
+// answerCNAME returns the record of an answer only made of a CNAME record
+func answerCNAME(answer []dns.RR) (*dns.CNAME, bool) {
+	if len(answer) != 1 {
+		return nil, false
+	}
+	cname, ok := answer[0].(*dns.CNAME)
+	return cname, ok
+}
+
+// PluginRPZResponse applies the RPZ-IP triggers to the addresses of the answers,
+// and the RPZ-NSDNAME triggers to the name servers found in responses
+type PluginRPZResponse struct {
+	rpz *PluginRPZ
+}
+
+func (plugin *PluginRPZResponse) Name() string {
+	return "rpz_response"
+}
+
+func (plugin *PluginRPZResponse) Description() string {
+	return "Apply the policies of Response Policy Zones to responses"
+}
+
+func (plugin *PluginRPZResponse) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginRPZResponse) Drop() error {
+	return nil
+}
+
+func (plugin *PluginRPZResponse) Reload() error {
+	return nil
+}
+
+func (plugin *PluginRPZResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.sessionData["whitelisted"] != nil || pluginsState.sessionData["rpz_passthru"] != nil {
+		return nil
+	}
+	questions := msg.Question
+	if len(questions) != 1 || questions[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	qName := strings.ToLower(StripTrailingDot(questions[0].Name))
+	for _, zone := range plugin.rpz.zones {
+		if rule := zone.matchResponse(msg); rule != nil {
+			return plugin.rpz.apply(pluginsState, msg, zone, rule, qName)
+		}
+	}
+	return nil
+}
+
+// matchResponse returns the rule of the first address of the answer section matching an RPZ-IP trigger,
+// or of the first name server matching an RPZ-NSDNAME trigger
+func (zone *rpzZone) matchResponse(msg *dns.Msg) *rpzRule {
+	for _, answer := range msg.Answer {
+		var ip net.IP
+		switch rr := answer.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if _, xrule := zone.ips.Lookup(ip); xrule != nil {
+			return xrule.(*rpzRule)
+		}
+	}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if ns, ok := rr.(*dns.NS); ok {
+				if rule := zone.nsdNames.match(strings.ToLower(StripTrailingDot(ns.Ns))); rule != nil {
+					return rule
+				}
+			}
+		}
+	}
+	return nil
+}
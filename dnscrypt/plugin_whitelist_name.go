@@ -6,7 +6,6 @@ import (
 	"net"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
@@ -14,8 +13,11 @@ import (
 )
 
 type PluginWhitelistName struct {
+	proxy           *Proxy
+	loadedRules     int
 	allWeeklyRanges *map[string]WeeklyRanges
 	patternMatcher  *PatternMatcher
+	groupMatchers   map[string]*PatternMatcher
 	logger          *lumberjack.Logger
 	format          string
 }
@@ -28,42 +30,34 @@ func (plugin *PluginWhitelistName) Description() string {
 	return "Whitelists DNS queries matching name patterns"
 }
 
+func whitelistNameGroupFile(clientGroup *ClientGroup) string {
+	return clientGroup.WhitelistNameFile
+}
+
+func loadWhitelistNameGroupRules(clientGroup *ClientGroup, fileName string) (*PatternMatcher, rulesCount, error) {
+	return loadNamePatterns(fileName, clientGroup.AllWeeklyRanges, "whitelist rules")
+}
+
 func (plugin *PluginWhitelistName) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of whitelisting rules from [%s]", proxy.WhitelistNameFile)
-	bin, err := ReadTextFile(proxy.WhitelistNameFile)
-	if err != nil {
-		return err
-	}
+	plugin.proxy = proxy
 	plugin.allWeeklyRanges = proxy.AllWeeklyRanges
-	plugin.patternMatcher = NewPatternPatcher()
-	for lineNo, line := range strings.Split(string(bin), "\n") {
-		line = strings.TrimFunc(line, unicode.IsSpace)
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
-			continue
+	if len(proxy.WhitelistNameFile) > 0 {
+		dlog.Noticef("Loading the set of whitelisting rules from [%s]", proxy.WhitelistNameFile)
+		patternMatcher, count, err := loadNamePatterns(proxy.WhitelistNameFile, plugin.allWeeklyRanges, "whitelist rules")
+		if err != nil {
+			return err
 		}
-		parts := strings.Split(line, "@")
-		timeRangeName := ""
-		if len(parts) == 2 {
-			line = strings.TrimFunc(parts[0], unicode.IsSpace)
-			timeRangeName = strings.TrimFunc(parts[1], unicode.IsSpace)
-		} else if len(parts) > 2 {
-			dlog.Errorf("Syntax error in whitelist rules at line %d -- Unexpected @ character", 1+lineNo)
-			continue
-		}
-		var weeklyRanges *WeeklyRanges
-		if len(timeRangeName) > 0 {
-			weeklyRangesX, ok := (*plugin.allWeeklyRanges)[timeRangeName]
-			if !ok {
-				dlog.Errorf("Time range [%s] not found at line %d", timeRangeName, 1+lineNo)
-			} else {
-				weeklyRanges = &weeklyRangesX
-			}
-		}
-		if _, err := plugin.patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
-			dlog.Error(err)
-			continue
+		if err := count.check(proxy.WhitelistNameFile); err != nil {
+			return err
 		}
+		plugin.patternMatcher = patternMatcher
+		plugin.loadedRules = count.valid
 	}
+	groupMatchers, err := proxy.loadClientGroupsRules("whitelisting rules", whitelistNameGroupFile, loadWhitelistNameGroupRules)
+	if err != nil {
+		return err
+	}
+	plugin.groupMatchers = groupMatchers
 	if len(proxy.WhitelistNameLogFile) == 0 {
 		return nil
 	}
@@ -78,16 +72,59 @@ func (plugin *PluginWhitelistName) Drop() error {
 }
 
 func (plugin *PluginWhitelistName) Reload() error {
+	var patternMatcher *PatternMatcher
+	var count rulesCount
+	if len(plugin.proxy.WhitelistNameFile) > 0 {
+		dlog.Noticef("Reloading the set of whitelisting rules from [%s]", plugin.proxy.WhitelistNameFile)
+		var err error
+		patternMatcher, count, err = loadNamePatterns(plugin.proxy.WhitelistNameFile, plugin.allWeeklyRanges, "whitelist rules")
+		if err != nil {
+			return err
+		}
+		if err := count.check(plugin.proxy.WhitelistNameFile); err != nil {
+			return err
+		}
+	}
+	groupMatchers, err := plugin.proxy.loadClientGroupsRules("whitelisting rules", whitelistNameGroupFile, loadWhitelistNameGroupRules)
+	if err != nil {
+		return err
+	}
+	plugin.proxy.pluginsGlobals.Lock()
+	plugin.patternMatcher = patternMatcher
+	plugin.groupMatchers = groupMatchers
+	plugin.loadedRules = count.valid
+	plugin.proxy.pluginsGlobals.Unlock()
 	return nil
 }
 
+func (plugin *PluginWhitelistName) loadedRulesCount() int {
+	plugin.proxy.pluginsGlobals.RLock()
+	defer plugin.proxy.pluginsGlobals.RUnlock()
+	return plugin.loadedRules
+}
+
+func (plugin *PluginWhitelistName) rulesFile() string {
+	return plugin.proxy.WhitelistNameFile
+}
+
+func (plugin *PluginWhitelistName) additionalRulesFiles() []string {
+	return plugin.proxy.clientGroupsFiles(whitelistNameGroupFile)
+}
+
 func (plugin *PluginWhitelistName) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	questions := msg.Question
 	if len(questions) != 1 {
 		return nil
 	}
+	patternMatcher := clientPatternMatcher(pluginsState, plugin.patternMatcher, plugin.groupMatchers)
+	if patternMatcher == nil {
+		return nil
+	}
 	qName := strings.ToLower(StripTrailingDot(questions[0].Name))
-	whitelist, reason, xweeklyRanges := plugin.patternMatcher.Eval(qName)
+	whitelist, reason, xweeklyRanges := patternMatcher.Eval(qName)
+	if !whitelist {
+		whitelist, reason = patternMatcher.EvalException(qName)
+	}
 	var weeklyRanges *WeeklyRanges
 	if xweeklyRanges != nil {
 		weeklyRanges = xweeklyRanges.(*WeeklyRanges)
@@ -118,6 +155,17 @@ func (plugin *PluginWhitelistName) Eval(pluginsState *PluginsState, msg *dns.Msg
 				line = fmt.Sprintf("%s\t%s\t%s\t%s\n", tsStr, clientIPStr, StringQuote(qName), StringQuote(reason))
 			} else if plugin.format == "ltsv" {
 				line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(reason))
+			} else if plugin.format == "json" {
+				var err error
+				line, err = jsonLogLine(struct {
+					Time  time.Time `json:"time"`
+					Host  string    `json:"host"`
+					QName string    `json:"qname"`
+					Rule  string    `json:"rule"`
+				}{time.Now(), clientIPStr, qName, reason})
+				if err != nil {
+					return err
+				}
 			} else {
 				dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 			}
@@ -2,6 +2,7 @@ package dnscrypt
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 )
 
 type PluginsAction int
@@ -23,12 +25,12 @@ const (
 
 type PluginsGlobals struct {
 	sync.RWMutex
-	queryPlugins           *[]Plugin
-	responsePlugins        *[]Plugin
-	loggingPlugins         *[]Plugin
-	refusedCodeInResponses bool
-	respondWithIPv4        net.IP
-	respondWithIPv6        net.IP
+	queryPlugins     *[]Plugin
+	responsePlugins  *[]Plugin
+	loggingPlugins   *[]Plugin
+	blockedResponse  blockedResponse
+	clientGroups     []*ClientGroup
+	clientIDNetworks []*net.IPNet
 }
 
 type PluginsReturnCode int
@@ -45,6 +47,7 @@ const (
 	PluginsReturnCodeServerError
 	PluginsReturnCodeCloak
 	PluginsReturnCodeServerTimeout
+	PluginsReturnCodeStale
 )
 
 var PluginsReturnCodeToString = map[PluginsReturnCode]string{
@@ -59,6 +62,7 @@ var PluginsReturnCodeToString = map[PluginsReturnCode]string{
 	PluginsReturnCodeServerError:   "SERVER_ERROR",
 	PluginsReturnCodeCloak:         "CLOAK",
 	PluginsReturnCodeServerTimeout: "SERVER_TIMEOUT",
+	PluginsReturnCodeStale:         "STALE",
 }
 
 type PluginsState struct {
@@ -69,18 +73,28 @@ type PluginsState struct {
 	maxPayloadSize                   int
 	clientProto                      string
 	clientAddr                       *net.Addr
+	clientGroup                      *ClientGroup
 	synthResponse                    *dns.Msg
+	synthPacket                      []byte
+	cnameTarget                      string
+	cnameChase                       bool
 	dnssec                           bool
-	cacheSize                        int
 	cacheNegMinTTL                   uint32
 	cacheNegMaxTTL                   uint32
 	cacheMinTTL                      uint32
 	cacheMaxTTL                      uint32
 	rejectTTL                        uint32
 	questionMsg                      *dns.Msg
+	responseMsg                      *dns.Msg
+	messages                         *exchangedMessages
 	requestStart                     time.Time
 	requestEnd                       time.Time
+	serverRtt                        time.Duration
 	cacheHit                         bool
+	cachePrefetch                    bool
+	staleResponse                    []byte
+	cacheTTL                         uint32
+	blockedRule                      string
 	returnCode                       PluginsReturnCode
 	serverName                       string
 }
@@ -91,19 +105,26 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.QueryMeta) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginQueryMeta)))
 	}
-	if len(proxy.WhitelistNameFile) != 0 {
+	if len(proxy.WhitelistNameFile) != 0 || proxy.hasClientGroupsFile(whitelistNameGroupFile) {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginWhitelistName)))
 	}
 
 	*queryPlugins = append(*queryPlugins, Plugin(new(PluginFirefox)))
 
-	if len(proxy.BlockNameFile) != 0 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockName)))
+	var blockName *PluginBlockName
+	if len(proxy.BlockNameFile) != 0 || proxy.hasClientGroupsFile(blockNameGroupFile) {
+		blockName = new(PluginBlockName)
+		*queryPlugins = append(*queryPlugins, Plugin(blockName))
+	}
+	var rpz *PluginRPZ
+	if len(proxy.RPZZoneFiles) != 0 {
+		rpz = new(PluginRPZ)
+		*queryPlugins = append(*queryPlugins, Plugin(rpz))
 	}
 	if proxy.PluginBlockIPv6 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockIPv6)))
 	}
-	if len(proxy.CloakFile) != 0 {
+	if len(proxy.CloakFile) != 0 || proxy.hasClientGroupsFile(cloakGroupFile) {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCloak)))
 	}
 	*queryPlugins = append(*queryPlugins, Plugin(new(PluginGetSetPayloadSize)))
@@ -118,6 +139,12 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.NXLogFile) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginNxLog)))
 	}
+	if blockName != nil {
+		*responsePlugins = append(*responsePlugins, Plugin(&PluginBlockNameResponse{blockName: blockName}))
+	}
+	if rpz != nil {
+		*responsePlugins = append(*responsePlugins, Plugin(&PluginRPZResponse{rpz: rpz}))
+	}
 	if len(proxy.BlockIPFile) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockIP)))
 	}
@@ -129,7 +156,13 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.QueryLogFile) != 0 {
 		*loggingPlugins = append(*loggingPlugins, Plugin(new(PluginQueryLog)))
 	}
+	if len(proxy.DnstapAddress) != 0 {
+		*loggingPlugins = append(*loggingPlugins, Plugin(new(PluginDnstap)))
+	}
 
+	if len(proxy.BlockNameLogFile) > 0 {
+		proxy.blockNameLogger = &lumberjack.Logger{LocalTime: true, MaxSize: proxy.LogMaxSize, MaxAge: proxy.LogMaxAge, MaxBackups: proxy.LogMaxBackups, Filename: proxy.BlockNameLogFile, Compress: true}
+	}
 	for _, plugin := range *queryPlugins {
 		if err := plugin.Init(proxy); err != nil {
 			return err
@@ -150,23 +183,100 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	proxy.pluginsGlobals.responsePlugins = responsePlugins
 	proxy.pluginsGlobals.loggingPlugins = loggingPlugins
 
-	parseBlockedQueryResponse(proxy.BlockedQueryResponse, &proxy.pluginsGlobals)
+	proxy.pluginsGlobals.blockedResponse = parseBlockedQueryResponse(proxy.BlockedQueryResponse)
+	for _, clientGroup := range proxy.ClientGroups {
+		if len(clientGroup.BlockedQueryResponse) > 0 {
+			clientGroup.blockedResponse = parseBlockedQueryResponse(clientGroup.BlockedQueryResponse)
+		} else {
+			clientGroup.blockedResponse = proxy.pluginsGlobals.blockedResponse
+		}
+	}
+	proxy.pluginsGlobals.clientGroups = proxy.ClientGroups
+	proxy.pluginsGlobals.clientIDNetworks = proxy.ClientIDNetworks
+
+	return nil
+}
+
+// ReloadPlugins reloads the rules of every plugin from their files.
+// Each plugin swaps in its new rules atomically. If a file cannot be read or contains invalid rules,
+// the plugin keeps its previous rules, and the first error is returned after all the plugins have been reloaded.
+func (proxy *Proxy) ReloadPlugins() error {
+	var err error
+	for _, plugin := range proxy.plugins() {
+		if reloadErr := proxy.reloadPlugin(plugin); reloadErr != nil && err == nil {
+			err = reloadErr
+		}
+	}
+	return err
+}
+
+// plugins returns the query, response and logging plugins
+func (proxy *Proxy) plugins() []Plugin {
+	proxy.pluginsGlobals.RLock()
+	defer proxy.pluginsGlobals.RUnlock()
+	var plugins []Plugin
+	for _, pluginsList := range []*[]Plugin{proxy.pluginsGlobals.queryPlugins, proxy.pluginsGlobals.responsePlugins, proxy.pluginsGlobals.loggingPlugins} {
+		if pluginsList != nil {
+			plugins = append(plugins, *pluginsList...)
+		}
+	}
+	return plugins
+}
+
+// reloadPlugin reloads the rules of a single plugin, keeping its previous rules on error
+func (proxy *Proxy) reloadPlugin(plugin Plugin) error {
+	proxy.reloadLock.Lock()
+	defer proxy.reloadLock.Unlock()
+	err := plugin.Reload()
+	if err != nil {
+		dlog.Errorf("Unable to reload [%s]: %s", plugin.Name(), err)
+	}
+	return err
+}
+
+// rulesFilePlugin is implemented by plugins whose rules are loaded from a file
+type rulesFilePlugin interface {
+	rulesFile() string
+	loadedRulesCount() int
+}
+
+// additionalRulesFilesPlugin is implemented by plugins also loading rules from other files, such as the files of client groups
+type additionalRulesFilesPlugin interface {
+	additionalRulesFiles() []string
+}
+
+// rulesCount is the number of valid and invalid rules found in a rules file
+type rulesCount struct {
+	valid   int
+	invalid int
+}
 
+// check logs the number of rules loaded from a file, or returns an error if the file only had invalid rules.
+// The same policy applies at startup and when reloading, invalid rules being otherwise ignored.
+func (count rulesCount) check(fileName string) error {
+	if count.valid == 0 && count.invalid > 0 {
+		return fmt.Errorf("No valid rules in [%s], %d invalid rules found", fileName, count.invalid)
+	}
+	if count.invalid > 0 {
+		dlog.Warnf("%d invalid rules ignored in [%s]", count.invalid, fileName)
+	}
+	dlog.Noticef("%d rules loaded from [%s]", count.valid, fileName)
 	return nil
 }
 
 // blockedQueryResponse can be 'refused', 'hinfo' or IP responses 'a:IPv4,aaaa:IPv6
-func parseBlockedQueryResponse(blockedResponse string, pluginsGlobals *PluginsGlobals) {
-	blockedResponse = StringStripSpaces(strings.ToLower(blockedResponse))
+func parseBlockedQueryResponse(blockedQueryResponse string) blockedResponse {
+	var response blockedResponse
+	blockedQueryResponse = StringStripSpaces(strings.ToLower(blockedQueryResponse))
 
-	if strings.HasPrefix(blockedResponse, "a:") {
-		blockedIPStrings := strings.Split(blockedResponse, ",")
-		(*pluginsGlobals).respondWithIPv4 = net.ParseIP(strings.TrimPrefix(blockedIPStrings[0], "a:"))
+	if strings.HasPrefix(blockedQueryResponse, "a:") {
+		blockedIPStrings := strings.Split(blockedQueryResponse, ",")
+		response.ipv4 = net.ParseIP(strings.TrimPrefix(blockedIPStrings[0], "a:"))
 
-		if (*pluginsGlobals).respondWithIPv4 == nil {
+		if response.ipv4 == nil {
 			dlog.Notice("Error parsing IPv4 response given in blocked_query_response option, defaulting to `hinfo`")
-			(*pluginsGlobals).refusedCodeInResponses = false
-			return
+			response.refusedCode = false
+			return response
 		}
 
 		if len(blockedIPStrings) > 1 {
@@ -175,9 +285,9 @@ func parseBlockedQueryResponse(blockedResponse string, pluginsGlobals *PluginsGl
 				if strings.HasPrefix(ipv6Response, "[") {
 					ipv6Response = strings.Trim(ipv6Response, "[]")
 				}
-				(*pluginsGlobals).respondWithIPv6 = net.ParseIP(ipv6Response)
+				response.ipv6 = net.ParseIP(ipv6Response)
 
-				if (*pluginsGlobals).respondWithIPv6 == nil {
+				if response.ipv6 == nil {
 					dlog.Notice("Error parsing IPv6 response given in blocked_query_response option, defaulting to IPv4")
 				}
 			} else {
@@ -185,21 +295,22 @@ func parseBlockedQueryResponse(blockedResponse string, pluginsGlobals *PluginsGl
 			}
 		}
 
-		if (*pluginsGlobals).respondWithIPv6 == nil {
-			(*pluginsGlobals).respondWithIPv6 = (*pluginsGlobals).respondWithIPv4
+		if response.ipv6 == nil {
+			response.ipv6 = response.ipv4
 		}
 
 	} else {
-		switch blockedResponse {
+		switch blockedQueryResponse {
 		case "refused":
-			(*pluginsGlobals).refusedCodeInResponses = true
+			response.refusedCode = true
 		case "hinfo":
-			(*pluginsGlobals).refusedCodeInResponses = false
+			response.refusedCode = false
 		default:
-			dlog.Noticef("Invalid blocked_query_response option [%s], defaulting to `hinfo`", blockedResponse)
-			(*pluginsGlobals).refusedCodeInResponses = false
+			dlog.Noticef("Invalid blocked_query_response option [%s], defaulting to `hinfo`", blockedQueryResponse)
+			response.refusedCode = false
 		}
 	}
+	return response
 }
 
 type Plugin interface {
@@ -212,12 +323,15 @@ type Plugin interface {
 }
 
 func NewPluginsState(proxy *Proxy, clientProto string, clientAddr *net.Addr, start time.Time) PluginsState {
+	var messages *exchangedMessages
+	if proxy.keepExchangedMessages {
+		messages = &exchangedMessages{}
+	}
 	return PluginsState{
 		action:                           PluginsActionForward,
 		maxPayloadSize:                   MaxDNSUDPPacketSize - ResponseOverhead,
 		clientProto:                      clientProto,
 		clientAddr:                       clientAddr,
-		cacheSize:                        proxy.CacheSize,
 		cacheNegMinTTL:                   proxy.CacheNegMinTTL,
 		cacheNegMaxTTL:                   proxy.CacheNegMaxTTL,
 		cacheMinTTL:                      proxy.CacheMinTTL,
@@ -226,9 +340,19 @@ func NewPluginsState(proxy *Proxy, clientProto string, clientAddr *net.Addr, sta
 		questionMsg:                      nil,
 		requestStart:                     start,
 		maxUnencryptedUDPSafePayloadSize: MaxDNSUDPSafePacketSize,
+		messages:                         messages,
 	}
 }
 
+// refusedResponse builds the response to a blocked query, as configured for the group of the client
+func (pluginsState *PluginsState) refusedResponse(pluginsGlobals *PluginsGlobals, msg *dns.Msg) (*dns.Msg, error) {
+	response := pluginsGlobals.blockedResponse
+	if clientGroup := pluginsState.clientGroup; clientGroup != nil {
+		response = clientGroup.blockedResponse
+	}
+	return RefusedResponseFromMessage(msg, response.refusedCode, response.ipv4, response.ipv6, pluginsState.rejectTTL)
+}
+
 func (pluginsState *PluginsState) ApplyQueryPlugins(pluginsGlobals *PluginsGlobals, packet []byte, serverName string) ([]byte, error) {
 	if len(*pluginsGlobals.queryPlugins) == 0 && len(*pluginsGlobals.loggingPlugins) == 0 {
 		return packet, nil
@@ -243,6 +367,13 @@ func (pluginsState *PluginsState) ApplyQueryPlugins(pluginsGlobals *PluginsGloba
 		return packet, errors.New("Unexpected number of questions")
 	}
 	pluginsState.questionMsg = &msg
+	if edns0 := msg.IsEdns0(); edns0 != nil {
+		pluginsState.dnssec = edns0.Do()
+	}
+	if !pluginsState.cachePrefetch {
+		pluginsState.clientGroup = findClientGroup(pluginsGlobals.clientGroups, pluginsGlobals.clientIDNetworks, pluginsState.clientAddr, &msg)
+	}
+	removeEDNSClientID(&msg)
 	pluginsGlobals.RLock()
 	defer pluginsGlobals.RUnlock()
 	for _, plugin := range *pluginsGlobals.queryPlugins {
@@ -251,7 +382,7 @@ func (pluginsState *PluginsState) ApplyQueryPlugins(pluginsGlobals *PluginsGloba
 			return packet, err
 		}
 		if pluginsState.action == PluginsActionReject {
-			synth, err := RefusedResponseFromMessage(&msg, pluginsGlobals.refusedCodeInResponses, pluginsGlobals.respondWithIPv4, pluginsGlobals.respondWithIPv6, pluginsState.rejectTTL)
+			synth, err := pluginsState.refusedResponse(pluginsGlobals, &msg)
 			if err != nil {
 				return nil, err
 			}
@@ -298,7 +429,7 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(pluginsGlobals *PluginsGl
 			return packet, err
 		}
 		if pluginsState.action == PluginsActionReject {
-			synth, err := RefusedResponseFromMessage(&msg, pluginsGlobals.refusedCodeInResponses, pluginsGlobals.respondWithIPv4, pluginsGlobals.respondWithIPv6, pluginsState.rejectTTL)
+			synth, err := pluginsState.refusedResponse(pluginsGlobals, &msg)
 			if err != nil {
 				return nil, err
 			}
@@ -312,6 +443,7 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(pluginsGlobals *PluginsGl
 	if ttl != nil {
 		setMaxTTL(&msg, *ttl)
 	}
+	pluginsState.responseMsg = &msg
 	packet2, err := msg.PackBuffer(packet)
 	if err != nil {
 		return packet, err
@@ -48,7 +48,7 @@ func (proxy *Proxy) dropPrivilege(userStr string, fds []*os.File) {
 		dlog.Fatal(err)
 	}
 
-	if err := ServiceManagerReadyNotify(); err != nil {
+	if err := ServiceManagerReadyNotify(nil); err != nil {
 		dlog.Fatal(err)
 	}
 
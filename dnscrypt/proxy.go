@@ -1,12 +1,17 @@
 package dnscrypt
 
 import (
+	"context"
 	crypto_rand "crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +20,12 @@ import (
 	stamps "github.com/jedisct1/go-dnsstamps"
 	"github.com/miekg/dns"
 	"golang.org/x/crypto/curve25519"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	TCPIdleTimeout        = 10 * time.Second
+	TCPMaxInFlightQueries = 32
 )
 
 type Proxy struct {
@@ -31,12 +42,28 @@ type Proxy struct {
 	CertIgnoreTimestamp          bool
 	MainProto                    string
 	ListenAddresses              []string
+	LocalDoHListenAddresses      []string
+	LocalDoHPath                 string
+	LocalDoHCertFile             string
+	LocalDoHCertKeyFile          string
+	LocalDoTListenAddresses      []string
+	LocalDoTCertFile             string
+	LocalDoTCertKeyFile          string
+	AdminAPIListenAddresses      []string
+	AdminAPIToken                string
+	MetricsListenAddresses       []string
+	MetricsPath                  string
 	Daemonize                    bool
 	RegisteredServers            []RegisteredServer
 	RegisteredRelays             []RegisteredServer
 	PluginBlockIPv6              bool
 	Cache                        bool
 	CacheSize                    int
+	CacheSnapshotFile            string
+	CacheSnapshotInterval        time.Duration
+	CacheStaleMaxAge             uint32
+	CacheStaleTTL                uint32
+	CachePrefetch                bool
 	CacheNegMinTTL               uint32
 	CacheNegMaxTTL               uint32
 	CacheMinTTL                  uint32
@@ -48,6 +75,9 @@ type Proxy struct {
 	QueryLogIgnoredQtypes        []string
 	NXLogFile                    string
 	NXLogFormat                  string
+	DnstapNetwork                string
+	DnstapAddress                string
+	DnstapIdentity               string
 	BlockNameFile                string
 	WhitelistNameFile            string
 	BlockNameLogFile             string
@@ -59,9 +89,14 @@ type Proxy struct {
 	BlockIPFormat                string
 	ForwardFile                  string
 	CloakFile                    string
+	RPZZoneFiles                 []string
+	WatchRulesFiles              bool
 	pluginsGlobals               PluginsGlobals
 	URLsToPrefetch               []*URLToPrefetch
 	clientsCount                 uint32
+	metrics                      *Metrics
+	keepExchangedMessages        bool
+	blockNameLogger              *lumberjack.Logger
 	MaxClients                   uint32
 	XTransport                   *XTransport
 	AllWeeklyRanges              *map[string]WeeklyRanges
@@ -69,66 +104,134 @@ type Proxy struct {
 	LogMaxAge                    int
 	LogMaxBackups                int
 	BlockedQueryResponse         string
+	ClientACL                    *ClientACL
+	ListenerClientACLs           map[string]*ClientACL
+	DeniedClientAction           string
+	RateLimit                    *RateLimit
+	ClientGroups                 []*ClientGroup
+	ClientIDNetworks             []*net.IPNet
 	QueryMeta                    []string
 	Routes                       *map[string][]string
 	ShowCerts                    bool
+	localDoHTLSConfig            *tls.Config
+	localDoTTLSConfig            *tls.Config
+	lifecycleLock                sync.Mutex
+	ctx                          context.Context
+	cancel                       context.CancelFunc
+	stopping                     bool
+	closers                      []func(context.Context) error
+	clientConns                  map[net.Conn]struct{}
+	background                   sync.WaitGroup
+	inFlight                     sync.WaitGroup
+	reloadLock                   sync.Mutex
 }
 
+// StartProxy runs the proxy until quit is closed, treating startup errors as fatal
 func (proxy *Proxy) StartProxy(quit <-chan struct{}) {
+	if err := proxy.Start(context.Background()); err != nil {
+		dlog.Fatal(err)
+	}
+	if proxy.ShowCerts {
+		os.Exit(0)
+	}
+	<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), proxy.Timeout)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		dlog.Warnf("Unable to cleanly stop the proxy: [%s]", err)
+	}
+}
+
+// Start binds the listeners, retrieves the certificates of the configured servers,
+// and starts the background tasks.
+// ctx only bounds the startup; the proxy keeps running until Shutdown is called.
+func (proxy *Proxy) Start(ctx context.Context) error {
+	proxy.lifecycleLock.Lock()
+	if proxy.ctx != nil {
+		proxy.lifecycleLock.Unlock()
+		return errors.New("Proxy already started")
+	}
+	proxy.ctx, proxy.cancel = context.WithCancel(context.Background())
+	proxy.lifecycleLock.Unlock()
+	if err := proxy.start(ctx); err != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), proxy.Timeout)
+		defer cancel()
+		proxy.Shutdown(shutdownCtx)
+		return err
+	}
+	return nil
+}
+
+func (proxy *Proxy) start(ctx context.Context) error {
 	proxy.questionSizeEstimator = NewQuestionSizeEstimator()
+	if len(proxy.MetricsListenAddresses) > 0 {
+		proxy.metrics = NewMetrics()
+	}
 	if _, err := crypto_rand.Read(proxy.proxySecretKey[:]); err != nil {
-		dlog.Fatal(err)
+		return err
 	}
 	curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
 	for _, registeredServer := range proxy.RegisteredServers {
 		proxy.ServersInfo.registerServer(registeredServer.Name, registeredServer.Stamp)
 	}
+	proxy.startCacheSnapshots()
+	if len(proxy.LocalDoHListenAddresses) > 0 {
+		tlsConfig, err := loadListenerTLSConfig(proxy.LocalDoHCertFile, proxy.LocalDoHCertKeyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load the certificate for the local DoH server: [%s]", err)
+		}
+		proxy.localDoHTLSConfig = tlsConfig
+	}
+	if len(proxy.LocalDoTListenAddresses) > 0 {
+		tlsConfig, err := loadListenerTLSConfig(proxy.LocalDoTCertFile, proxy.LocalDoTCertKeyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load the certificate for the local DoT server: [%s]", err)
+		}
+		tlsConfig.NextProtos = []string{"dot"}
+		proxy.localDoTTLSConfig = tlsConfig
+	}
 
 	for _, listenAddrStr := range proxy.ListenAddresses {
 		listenUDPAddr, err := net.ResolveUDPAddr("udp", listenAddrStr)
 		if err != nil {
-			dlog.Fatal(err)
+			return err
 		}
 		listenTCPAddr, err := net.ResolveTCPAddr("tcp", listenAddrStr)
 		if err != nil {
-			dlog.Fatal(err)
+			return err
 		}
 
 		// if 'userName' is not set, continue as before
 		if !(len(proxy.UserName) > 0) {
-			udpCloser, err := proxy.udpListenerFromAddr(listenUDPAddr)
-			if err != nil {
-				dlog.Fatal(err)
+			if err := proxy.udpListenerFromAddr(listenUDPAddr); err != nil {
+				return err
 			}
-			tcpCloser, err := proxy.tcpListenerFromAddr(listenTCPAddr)
-			if err != nil {
-				dlog.Fatal(err)
+			if err := proxy.tcpListenerFromAddr(listenTCPAddr); err != nil {
+				return err
 			}
-			defer udpCloser.Close()
-			defer tcpCloser.Close()
 		} else {
 			// if 'userName' is set and we are the parent process
 			if !proxy.Child {
 				// parent
 				listenerUDP, err := net.ListenUDP("udp", listenUDPAddr)
 				if err != nil {
-					dlog.Fatal(err)
+					return err
 				}
+				proxy.addCloser(closerFunc(listenerUDP))
 				listenerTCP, err := net.ListenTCP("tcp", listenTCPAddr)
 				if err != nil {
-					dlog.Fatal(err)
+					return err
 				}
+				proxy.addCloser(closerFunc(listenerTCP))
 
 				fdUDP, err := listenerUDP.File() // On Windows, the File method of UDPConn is not implemented.
 				if err != nil {
-					dlog.Fatalf("Unable to switch to a different user: %v", err)
+					return fmt.Errorf("Unable to switch to a different user: %v", err)
 				}
 				fdTCP, err := listenerTCP.File() // On Windows, the File method of TCPListener is not implemented.
 				if err != nil {
-					dlog.Fatalf("Unable to switch to a different user: %v", err)
+					return fmt.Errorf("Unable to switch to a different user: %v", err)
 				}
-				defer listenerUDP.Close()
-				defer listenerTCP.Close()
 				FileDescriptors = append(FileDescriptors, fdUDP)
 				FileDescriptors = append(FileDescriptors, fdTCP)
 
@@ -137,69 +240,267 @@ func (proxy *Proxy) StartProxy(quit <-chan struct{}) {
 				// child
 				listenerUDP, err := net.FilePacketConn(os.NewFile(uintptr(3+FileDescriptorNum), "listenerUDP"))
 				if err != nil {
-					dlog.Fatalf("Unable to switch to a different user: %v", err)
+					return fmt.Errorf("Unable to switch to a different user: %v", err)
 				}
 				FileDescriptorNum++
 
 				listenerTCP, err := net.FileListener(os.NewFile(uintptr(3+FileDescriptorNum), "listenerTCP"))
 				if err != nil {
-					dlog.Fatalf("Unable to switch to a different user: %v", err)
+					listenerUDP.Close()
+					return fmt.Errorf("Unable to switch to a different user: %v", err)
 				}
 				FileDescriptorNum++
 
 				dlog.Noticef("Now listening to %v [UDP]", listenUDPAddr)
-				go proxy.udpListener(listenerUDP.(*net.UDPConn))
+				proxy.serveUDP(listenerUDP.(*net.UDPConn))
 
 				dlog.Noticef("Now listening to %v [TCP]", listenAddrStr)
-				go proxy.tcpListener(listenerTCP.(*net.TCPListener))
+				proxy.serveStream(listenerTCP.(*net.TCPListener), proxy.tcpListener)
 			}
 		}
 	}
 
+	for _, listenAddrStr := range proxy.LocalDoHListenAddresses {
+		if err := proxy.startStreamListener(listenAddrStr, "DoH", proxy.localDoHListenerFromAddr, proxy.localDoHListener); err != nil {
+			return err
+		}
+	}
+	for _, listenAddrStr := range proxy.LocalDoTListenAddresses {
+		if err := proxy.startStreamListener(listenAddrStr, "DoT", proxy.localDoTListenerFromAddr, proxy.localDoTListener); err != nil {
+			return err
+		}
+	}
+
 	// if 'userName' is set and we are the parent process drop privilege and exit
 	if len(proxy.UserName) > 0 && !proxy.Child {
 		proxy.dropPrivilege(proxy.UserName, FileDescriptors)
 	}
-	sdc, err := proxy.SystemDListeners()
-	if err != nil {
-		dlog.Fatal(err)
+	if err := proxy.SystemDListeners(); err != nil {
+		return err
 	}
-	defer sdc.Close()
-	liveServers, err := proxy.ServersInfo.refresh(proxy)
-	if liveServers > 0 {
-		proxy.CertIgnoreTimestamp = false
+	if proxy.WatchRulesFiles {
+		proxy.startRulesFilesWatcher()
 	}
-	if proxy.ShowCerts {
-		os.Exit(0)
+	if err := proxy.startAdminAPI(); err != nil {
+		return err
+	}
+	if err := proxy.startMetricsServer(); err != nil {
+		return err
 	}
+
+	liveServersChan := make(chan int, 1)
+	errChan := make(chan error, 1)
+	proxy.goBackground(func() {
+		liveServers, err := proxy.ServersInfo.refresh(proxy)
+		liveServersChan <- liveServers
+		errChan <- err
+	})
+	var liveServers int
+	select {
+	case liveServers = <-liveServersChan:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	err := <-errChan
 	if liveServers > 0 {
 		dlog.Noticef("dnscrypt-proxy is ready - live servers: %d", liveServers)
 		if !proxy.Child {
-			if err := ServiceManagerReadyNotify(); err != nil {
-				dlog.Fatal(err)
+			if err := ServiceManagerReadyNotify(proxy.ctx.Done()); err != nil {
+				return err
 			}
 		}
 	} else if err != nil {
 		dlog.Error(err)
 		dlog.Notice("dnscrypt-proxy is waiting for at least one server to be reachable")
 	}
-	go proxy.prefetcher()
+	proxy.goBackground(proxy.prefetcher)
 	if len(proxy.ServersInfo.registeredServers) > 0 {
-		go func() {
+		proxy.goBackground(func() {
 			for {
 				delay := proxy.CertRefreshDelay
 				if liveServers == 0 {
 					delay = proxy.CertRefreshDelayAfterFailure
 				}
-				clocksmith.Sleep(delay)
-				liveServers, _ = proxy.ServersInfo.refresh(proxy)
-				if liveServers > 0 {
-					proxy.CertIgnoreTimestamp = false
+				if !proxy.sleep(delay) {
+					return
 				}
+				liveServers, _ = proxy.ServersInfo.refresh(proxy)
 			}
+		})
+	}
+	return nil
+}
+
+// Shutdown closes the listeners, stops the background tasks, and waits for
+// the queries being processed to be answered, or for ctx to be done
+func (proxy *Proxy) Shutdown(ctx context.Context) error {
+	proxy.lifecycleLock.Lock()
+	if proxy.ctx == nil || proxy.stopping {
+		proxy.lifecycleLock.Unlock()
+		return nil
+	}
+	proxy.stopping = true
+	proxy.cancel()
+	closers := proxy.closers
+	proxy.closers = nil
+	clientConns := proxy.clientConns
+	proxy.clientConns = nil
+	proxy.lifecycleLock.Unlock()
+
+	var err error
+	for _, closer := range closers {
+		if closeErr := closer(ctx); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	for clientConn := range clientConns {
+		clientConn.SetReadDeadline(time.Now())
+	}
+	drained := make(chan struct{})
+	go func() {
+		proxy.background.Wait()
+		proxy.inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		// Upstream connections still used by queries being answered are closed as soon as these queries complete,
+		// and the connections of servers added by a refresh still in progress once it is done
+		proxy.closeServersConnections()
+		go func() {
+			<-drained
+			proxy.closeServersConnections()
 		}()
+		return ctx.Err()
 	}
-	<-quit
+	proxy.closeServersConnections()
+	dlog.Debug("Proxy stopped")
+	return err
+}
+
+func (proxy *Proxy) closeServersConnections() {
+	proxy.ServersInfo.RLock()
+	for _, serverInfo := range proxy.ServersInfo.inner {
+		serverInfo.closeConnections()
+	}
+	proxy.ServersInfo.RUnlock()
+}
+
+func closerFunc(closer io.Closer) func(context.Context) error {
+	return func(context.Context) error {
+		return closer.Close()
+	}
+}
+
+// addCloser registers a function closing a listener when the proxy is shut down.
+// If the proxy is already being shut down, the listener is immediately closed, and false is returned.
+func (proxy *Proxy) addCloser(closer func(context.Context) error) bool {
+	proxy.lifecycleLock.Lock()
+	if proxy.stopping {
+		proxy.lifecycleLock.Unlock()
+		closer(context.Background())
+		return false
+	}
+	proxy.closers = append(proxy.closers, closer)
+	proxy.lifecycleLock.Unlock()
+	return true
+}
+
+// goBackground runs a task that Shutdown waits for
+func (proxy *Proxy) goBackground(task func()) {
+	proxy.background.Add(1)
+	go func() {
+		defer proxy.background.Done()
+		task()
+	}()
+}
+
+// addClientConn registers a client connection, so that it stops waiting for
+// new queries when the proxy is shut down
+func (proxy *Proxy) addClientConn(clientPc net.Conn) bool {
+	proxy.lifecycleLock.Lock()
+	defer proxy.lifecycleLock.Unlock()
+	if proxy.stopping {
+		return false
+	}
+	if proxy.clientConns == nil {
+		proxy.clientConns = make(map[net.Conn]struct{})
+	}
+	proxy.clientConns[clientPc] = struct{}{}
+	return true
+}
+
+func (proxy *Proxy) removeClientConn(clientPc net.Conn) {
+	proxy.lifecycleLock.Lock()
+	delete(proxy.clientConns, clientPc)
+	proxy.lifecycleLock.Unlock()
+}
+
+// sleep pauses like clocksmith.Sleep, but returns false as soon as the proxy is shut down
+func (proxy *Proxy) sleep(duration time.Duration) bool {
+	start := time.Now().Round(0)
+	for {
+		remaining := duration - time.Now().Round(0).Sub(start)
+		if remaining <= 0 {
+			return true
+		}
+		if remaining > clocksmith.DefaultGranularity {
+			remaining = clocksmith.DefaultGranularity
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-timer.C:
+		case <-proxy.ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// startStreamListener binds a TCP listener for an additional service, handing
+// the socket over to the child process if privileges have to be dropped
+func (proxy *Proxy) startStreamListener(listenAddrStr string, description string, listenerFromAddr func(*net.TCPAddr) error, listener func(*net.TCPListener)) error {
+	listenTCPAddr, err := net.ResolveTCPAddr("tcp", listenAddrStr)
+	if err != nil {
+		return err
+	}
+	if !(len(proxy.UserName) > 0) {
+		return listenerFromAddr(listenTCPAddr)
+	}
+	if !proxy.Child {
+		listenerTCP, err := net.ListenTCP("tcp", listenTCPAddr)
+		if err != nil {
+			return err
+		}
+		proxy.addCloser(closerFunc(listenerTCP))
+		fdTCP, err := listenerTCP.File()
+		if err != nil {
+			return fmt.Errorf("Unable to switch to a different user: %v", err)
+		}
+		FileDescriptors = append(FileDescriptors, fdTCP)
+		return nil
+	}
+	listenerTCP, err := net.FileListener(os.NewFile(uintptr(3+FileDescriptorNum), "listenerTCP"))
+	if err != nil {
+		return fmt.Errorf("Unable to switch to a different user: %v", err)
+	}
+	FileDescriptorNum++
+	dlog.Noticef("Now listening to %v [%s]", listenAddrStr, description)
+	proxy.serveStream(listenerTCP.(*net.TCPListener), listener)
+	return nil
+}
+
+// loadListenerTLSConfig loads the certificate served by a local DoH or DoT listener
+func loadListenerTLSConfig(certFile string, certKeyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, certKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
 }
 
 func (proxy *Proxy) prefetcher() {
@@ -215,11 +516,29 @@ func (proxy *Proxy) prefetcher() {
 				}
 			}
 		}
-		clocksmith.Sleep(60 * time.Second)
+		if !proxy.sleep(60 * time.Second) {
+			return
+		}
+	}
+}
+
+// serveUDP answers queries received on a UDP socket until the proxy is shut down
+func (proxy *Proxy) serveUDP(clientPc *net.UDPConn) {
+	if proxy.addCloser(closerFunc(clientPc)) {
+		proxy.goBackground(func() { proxy.udpListener(clientPc) })
+	}
+}
+
+// serveStream accepts connections using the given listener until the proxy is shut down
+func (proxy *Proxy) serveStream(acceptPc *net.TCPListener, listener func(*net.TCPListener)) {
+	if proxy.addCloser(closerFunc(acceptPc)) {
+		proxy.goBackground(func() { listener(acceptPc) })
 	}
 }
 
 func (proxy *Proxy) udpListener(clientPc *net.UDPConn) {
+	localAddr := clientPc.LocalAddr()
+	clientACL := proxy.listenerClientACL(localAddr)
 	for {
 		buffer := make([]byte, MaxDNSPacketSize-1)
 		length, clientAddr, err := clientPc.ReadFrom(buffer)
@@ -227,7 +546,31 @@ func (proxy *Proxy) udpListener(clientPc *net.UDPConn) {
 			return
 		}
 		packet := buffer[:length]
+		if !clientACL.allows(clientAddr) {
+			proxy.noticeDeniedClient(clientAddr, localAddr)
+			if proxy.DeniedClientAction == DeniedClientActionRefused {
+				if response := minimalResponse(packet, dns.RcodeRefused, false); response != nil {
+					clientPc.WriteTo(response, clientAddr)
+				}
+			}
+			continue
+		}
+		if rateLimit := proxy.rateLimitedQuery(clientAddr, false); rateLimit != nil {
+			var response []byte
+			switch rateLimit.Action {
+			case RateLimitActionRefused:
+				response = minimalResponse(packet, dns.RcodeRefused, false)
+			case RateLimitActionTruncate:
+				response = minimalResponse(packet, dns.RcodeSuccess, true)
+			}
+			if response != nil {
+				clientPc.WriteTo(response, clientAddr)
+			}
+			continue
+		}
+		proxy.inFlight.Add(1)
 		go func() {
+			defer proxy.inFlight.Done()
 			start := time.Now()
 			if !proxy.clientsCountInc() {
 				dlog.Warnf("Too many connections (max=%d)", proxy.MaxClients)
@@ -239,49 +582,121 @@ func (proxy *Proxy) udpListener(clientPc *net.UDPConn) {
 	}
 }
 
-func (proxy *Proxy) udpListenerFromAddr(listenAddr *net.UDPAddr) (io.Closer, error) {
+func (proxy *Proxy) udpListenerFromAddr(listenAddr *net.UDPAddr) error {
 	clientPc, err := net.ListenUDP("udp", listenAddr)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	dlog.Noticef("Now listening to %v [UDP]", listenAddr)
-	go proxy.udpListener(clientPc)
-	return clientPc, nil
+	proxy.serveUDP(clientPc)
+	return nil
 }
 
 func (proxy *Proxy) tcpListener(acceptPc *net.TCPListener) {
+	localAddr := acceptPc.Addr()
+	clientACL := proxy.listenerClientACL(localAddr)
 	for {
 		clientPc, err := acceptPc.Accept()
 		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				continue
+			}
+			return
+		}
+		if !clientACL.allows(clientPc.RemoteAddr()) {
+			proxy.denyStreamClient(clientPc, localAddr)
 			continue
 		}
+		proxy.goSession(clientPc, "tcp", "tcp", TCPIdleTimeout)
+	}
+}
+
+// goSession serves a client connection in the background, the proxy waiting for it to end before stopping
+func (proxy *Proxy) goSession(clientPc net.Conn, clientProto string, serverProto string, idleTimeout time.Duration) {
+	proxy.inFlight.Add(1)
+	go func() {
+		defer proxy.inFlight.Done()
+		proxy.tcpSession(clientPc, clientProto, serverProto, idleTimeout)
+	}()
+}
+
+// A client connection can carry multiple queries, that are answered as soon as
+// responses are available, possibly out of order (RFC 7766, section 6.2.1)
+func (proxy *Proxy) tcpSession(clientPc net.Conn, clientProto string, serverProto string, idleTimeout time.Duration) {
+	defer clientPc.Close()
+	if !proxy.addClientConn(clientPc) {
+		return
+	}
+	defer proxy.removeClientConn(clientPc)
+	if !proxy.clientsCountInc() {
+		dlog.Warnf("Too many connections (max=%d)", proxy.MaxClients)
+		return
+	}
+	defer proxy.clientsCountDec()
+	clientAddr := clientPc.RemoteAddr()
+	var writeLock sync.Mutex
+	var inFlight sync.WaitGroup
+	inFlightSlots := make(chan struct{}, TCPMaxInFlightQueries)
+	for {
+		// Shutdown cancels the context before interrupting the reads, so checking it after the deadline is set
+		// ensures that the deadline set by Shutdown is never replaced
+		clientPc.SetReadDeadline(time.Now().Add(idleTimeout))
+		if proxy.ctx.Err() != nil {
+			break
+		}
+		packet, err := ReadPrefixed(&clientPc)
+		if err != nil {
+			if err != io.EOF {
+				dlog.Debugf("Connection with [%v] closed: [%s]", clientAddr, err)
+			}
+			break
+		}
+		start := time.Now()
+		if rateLimit := proxy.rateLimitedQuery(clientAddr, true); rateLimit != nil {
+			if response := minimalResponse(packet, dns.RcodeRefused, false); response != nil && rateLimit.Action == RateLimitActionRefused {
+				if prefixedResponse, err := PrefixWithSize(response); err == nil {
+					writeLock.Lock()
+					clientPc.SetWriteDeadline(time.Now().Add(proxy.Timeout))
+					clientPc.Write(prefixedResponse)
+					writeLock.Unlock()
+				}
+			}
+			continue
+		}
+		inFlightSlots <- struct{}{}
+		inFlight.Add(1)
 		go func() {
-			start := time.Now()
-			defer clientPc.Close()
-			if !proxy.clientsCountInc() {
-				dlog.Warnf("Too many connections (max=%d)", proxy.MaxClients)
+			defer func() {
+				<-inFlightSlots
+				inFlight.Done()
+			}()
+			response := proxy.processIncomingQuery(proxy.ServersInfo.getOne(), clientProto, serverProto, packet, &clientAddr, nil, start)
+			if len(response) == 0 {
 				return
 			}
-			defer proxy.clientsCountDec()
-			clientPc.SetDeadline(time.Now().Add(proxy.Timeout))
-			packet, err := ReadPrefixed(&clientPc)
+			prefixedResponse, err := PrefixWithSize(response)
 			if err != nil {
 				return
 			}
-			clientAddr := clientPc.RemoteAddr()
-			proxy.processIncomingQuery(proxy.ServersInfo.getOne(), "tcp", "tcp", packet, &clientAddr, clientPc, start)
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			clientPc.SetWriteDeadline(time.Now().Add(proxy.Timeout))
+			if _, err := clientPc.Write(prefixedResponse); err != nil {
+				clientPc.Close()
+			}
 		}()
 	}
+	inFlight.Wait()
 }
 
-func (proxy *Proxy) tcpListenerFromAddr(listenAddr *net.TCPAddr) (io.Closer, error) {
+func (proxy *Proxy) tcpListenerFromAddr(listenAddr *net.TCPAddr) error {
 	acceptPc, err := net.ListenTCP("tcp", listenAddr)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	dlog.Noticef("Now listening to %v [TCP]", listenAddr)
-	go proxy.tcpListener(acceptPc)
-	return acceptPc, nil
+	proxy.serveStream(acceptPc, proxy.tcpListener)
+	return nil
 }
 
 func (proxy *Proxy) prepareForRelay(ip net.IP, port int, encryptedQuery *[]byte) {
@@ -295,60 +710,79 @@ func (proxy *Proxy) prepareForRelay(ip net.IP, port int, encryptedQuery *[]byte)
 }
 
 func (proxy *Proxy) exchangeWithUDPServer(serverInfo *ServerInfo, sharedKey *[32]byte, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
-	upstreamAddr := serverInfo.UDPAddr
 	if serverInfo.RelayUDPAddr != nil {
-		upstreamAddr = serverInfo.RelayUDPAddr
+		proxy.prepareForRelay(serverInfo.UDPAddr.IP, serverInfo.UDPAddr.Port, &encryptedQuery)
 	}
-	pc, err := net.DialUDP("udp", nil, upstreamAddr)
+	encryptedResponse, err := serverInfo.connPool.ExchangeUDP(encryptedQuery, clientNonce, serverInfo.Timeout)
 	if err != nil {
 		return nil, err
 	}
-	defer pc.Close()
-	pc.SetDeadline(time.Now().Add(serverInfo.Timeout))
-	if serverInfo.RelayUDPAddr != nil {
-		proxy.prepareForRelay(serverInfo.UDPAddr.IP, serverInfo.UDPAddr.Port, &encryptedQuery)
+	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+}
+
+func (proxy *Proxy) exchangeWithTCPServer(serverInfo *ServerInfo, sharedKey *[32]byte, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
+	if serverInfo.RelayTCPAddr != nil {
+		proxy.prepareForRelay(serverInfo.TCPAddr.IP, serverInfo.TCPAddr.Port, &encryptedQuery)
+	}
+	encryptedQuery, err := PrefixWithSize(encryptedQuery)
+	if err != nil {
+		return nil, err
 	}
-	pc.Write(encryptedQuery)
-	encryptedResponse := make([]byte, MaxDNSPacketSize)
-	length, err := pc.Read(encryptedResponse)
+	encryptedResponse, err := serverInfo.connPool.ExchangeTCP(encryptedQuery, serverInfo.Timeout)
 	if err != nil {
 		return nil, err
 	}
-	encryptedResponse = encryptedResponse[:length]
 	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
 }
 
-func (proxy *Proxy) exchangeWithTCPServer(serverInfo *ServerInfo, sharedKey *[32]byte, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
-	upstreamAddr := serverInfo.TCPAddr
-	if serverInfo.RelayUDPAddr != nil {
-		upstreamAddr = serverInfo.RelayTCPAddr
-	}
+func (proxy *Proxy) exchangeWithPlainServer(serverInfo *ServerInfo, proto string, query []byte) ([]byte, error) {
 	var err error
 	var pc net.Conn
 	proxyDialer := proxy.XTransport.ProxyDialer
-	if proxyDialer == nil {
-		pc, err = net.DialTCP("tcp", nil, upstreamAddr)
+	if proto == "udp" {
+		pc, err = net.DialUDP("udp", nil, serverInfo.UDPAddr)
+	} else if proxyDialer == nil {
+		pc, err = net.DialTCP("tcp", nil, serverInfo.TCPAddr)
 	} else {
-		pc, err = (*proxyDialer).Dial("tcp", serverInfo.TCPAddr.String())
+		pc, err = dialWithTimeout(*proxyDialer, "tcp", serverInfo.TCPAddr.String(), serverInfo.Timeout)
 	}
 	if err != nil {
 		return nil, err
 	}
 	defer pc.Close()
 	pc.SetDeadline(time.Now().Add(serverInfo.Timeout))
-	if serverInfo.RelayTCPAddr != nil {
-		proxy.prepareForRelay(serverInfo.TCPAddr.IP, serverInfo.TCPAddr.Port, &encryptedQuery)
+	tid := TransactionID(query)
+	if proto == "udp" {
+		if _, err := pc.Write(query); err != nil {
+			return nil, err
+		}
+		buffer := make([]byte, MaxDNSPacketSize)
+		for {
+			length, err := pc.Read(buffer)
+			if err != nil {
+				return nil, err
+			}
+			if length >= MinDNSPacketSize && TransactionID(buffer[:length]) == tid {
+				return buffer[:length], nil
+			}
+			dlog.Debugf("[%s] Ignoring a response with an unexpected transaction ID", serverInfo.Name)
+		}
 	}
-	encryptedQuery, err = PrefixWithSize(encryptedQuery)
+	prefixedQuery, err := PrefixWithSize(append([]byte{}, query...))
 	if err != nil {
 		return nil, err
 	}
-	pc.Write(encryptedQuery)
-	encryptedResponse, err := ReadPrefixed(&pc)
+	if _, err := pc.Write(prefixedQuery); err != nil {
+		return nil, err
+	}
+	response, err := ReadPrefixed(&pc)
 	if err != nil {
 		return nil, err
 	}
-	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+	if TransactionID(response) != tid {
+		return nil, errors.New("Unexpected transaction ID")
+	}
+	return response, nil
 }
 
 func (proxy *Proxy) clientsCountInc() bool {
@@ -372,44 +806,141 @@ func (proxy *Proxy) clientsCountDec() {
 	}
 }
 
-func (proxy *Proxy) processIncomingQuery(serverInfo *ServerInfo, clientProto string, serverProto string, query []byte, clientAddr *net.Addr, clientPc net.Conn, start time.Time) {
+func (proxy *Proxy) processIncomingQuery(serverInfo *ServerInfo, clientProto string, serverProto string, query []byte, clientAddr *net.Addr, clientPc net.Conn, start time.Time) []byte {
 	if len(query) < MinDNSPacketSize {
-		return
+		return nil
 	}
 	pluginsState := NewPluginsState(proxy, clientProto, clientAddr, start)
 	defer pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+	defer proxy.metrics.countQuery(&pluginsState, serverInfo)
+	response := proxy.processQuery(&pluginsState, serverInfo, serverProto, query)
+	if len(response) == 0 {
+		return nil
+	}
+	if clientProto == "udp" {
+		var err error
+		if len(response) > pluginsState.maxUnencryptedUDPSafePayloadSize {
+			response, err = TruncatedResponse(response)
+			if err != nil {
+				pluginsState.returnCode = PluginsReturnCodeParseError
+				return nil
+			}
+			pluginsState.messages.setClientResponse(response)
+		}
+		clientPc.(net.PacketConn).WriteTo(response, *clientAddr)
+		if HasTCFlag(response) {
+			proxy.questionSizeEstimator.blindAdjust()
+		} else {
+			proxy.questionSizeEstimator.adjust(ResponseOverhead + len(response))
+		}
+	}
+	return response
+}
+
+// processQuery applies the query plugins, forwards the query to the server if required,
+// and returns the response, the outcome being recorded in pluginsState.
+// An expired response from the cache is returned instead if the server couldn't answer.
+func (proxy *Proxy) processQuery(pluginsState *PluginsState, serverInfo *ServerInfo, serverProto string, query []byte) []byte {
+	response := proxy.resolveQuery(pluginsState, serverInfo, serverProto, query)
+	if pluginsState.staleResponse == nil {
+		return response
+	}
+	if len(response) == 0 {
+		if pluginsState.returnCode != PluginsReturnCodeServerTimeout && pluginsState.returnCode != PluginsReturnCodeServerError {
+			return response
+		}
+	} else if Rcode(response) != dns.RcodeServerFailure {
+		return response
+	}
+	staleResponse := pluginsState.staleResponse
+	if questionMsg := pluginsState.questionMsg; questionMsg != nil && len(questionMsg.Question) > 0 {
+		dlog.Debugf("Serving a stale response for [%s]", questionMsg.Question[0].Name)
+	}
+	pluginsState.returnCode = PluginsReturnCodeStale
+	pluginsState.cacheHit = true
+	pluginsState.messages.setClientResponse(staleResponse)
+	return staleResponse
+}
+
+// resolveCNAMETarget resolves the target of the CNAME record of a synthetic response,
+// and appends the records of the response to its answer.
+// The plugins are applied to the query for the target, but its CNAME records are not followed.
+func (proxy *Proxy) resolveCNAMETarget(pluginsState *PluginsState, serverInfo *ServerInfo, serverProto string) {
+	questionMsg := pluginsState.questionMsg
+	if questionMsg == nil || len(questionMsg.Question) != 1 {
+		return
+	}
+	question := questionMsg.Question[0]
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(pluginsState.cnameTarget), question.Qtype)
+	msg.Question[0].Qclass = question.Qclass
+	if edns0 := questionMsg.IsEdns0(); edns0 != nil {
+		msg.SetEdns0(edns0.UDPSize(), edns0.Do())
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	targetPluginsState := NewPluginsState(proxy, pluginsState.clientProto, pluginsState.clientAddr, time.Now())
+	targetPluginsState.messages = nil
+	targetPluginsState.cnameChase = true
+	packet := proxy.processQuery(&targetPluginsState, serverInfo, serverProto, query)
+	if len(packet) == 0 {
+		dlog.Debugf("No response for [%s], the target of [%s]", msg.Question[0].Name, question.Name)
+		return
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(packet); err != nil {
+		return
+	}
+	synth := pluginsState.synthResponse
+	synth.Answer = append(synth.Answer, response.Answer...)
+	if response.Rcode == dns.RcodeNameError {
+		synth.Rcode = dns.RcodeNameError
+	}
+}
+
+func (proxy *Proxy) resolveQuery(pluginsState *PluginsState, serverInfo *ServerInfo, serverProto string, query []byte) []byte {
 	serverName := "-"
 	if serverInfo != nil {
 		serverName = serverInfo.Name
 	}
+	pluginsState.messages.setClientQuery(query)
 	query, _ = pluginsState.ApplyQueryPlugins(&proxy.pluginsGlobals, query, serverName)
 	if len(query) < MinDNSPacketSize || len(query) > MaxDNSPacketSize {
-		return
+		return nil
 	}
 	var response []byte
 	var err error
 	if pluginsState.action != PluginsActionForward {
-		if pluginsState.synthResponse != nil {
+		if pluginsState.synthPacket != nil {
+			response = pluginsState.synthPacket
+		} else if pluginsState.synthResponse != nil {
+			if len(pluginsState.cnameTarget) > 0 && pluginsState.action == PluginsActionSynth {
+				proxy.resolveCNAMETarget(pluginsState, serverInfo, serverProto)
+			}
 			response, err = pluginsState.synthResponse.PackBuffer(response)
 			if err != nil {
 				pluginsState.returnCode = PluginsReturnCodeParseError
-				return
+				return nil
 			}
 		}
 		if pluginsState.action == PluginsActionDrop {
 			pluginsState.returnCode = PluginsReturnCodeDrop
-			return
+			return nil
 		}
 	} else {
 		pluginsState.returnCode = PluginsReturnCodeForward
 	}
 	if len(response) == 0 && serverInfo != nil {
 		var ttl *uint32
+		exchangeStart := time.Now()
+		pluginsState.messages.setServerQuery(serverInfo, serverProto, query, exchangeStart)
 		if serverInfo.Proto == stamps.StampProtoTypeDNSCrypt {
 			sharedKey, encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, serverProto)
 			if err != nil {
 				pluginsState.returnCode = PluginsReturnCodeParseError
-				return
+				return nil
 			}
 			serverInfo.noticeBegin(proxy)
 			if serverProto == "udp" {
@@ -419,7 +950,7 @@ func (proxy *Proxy) processIncomingQuery(serverInfo *ServerInfo, clientProto str
 					sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, serverProto)
 					if err != nil {
 						pluginsState.returnCode = PluginsReturnCodeParseError
-						return
+						return nil
 					}
 					response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
 				}
@@ -433,7 +964,7 @@ func (proxy *Proxy) processIncomingQuery(serverInfo *ServerInfo, clientProto str
 					pluginsState.returnCode = PluginsReturnCodeServerError
 				}
 				serverInfo.noticeFailure(proxy)
-				return
+				return nil
 			}
 		} else if serverInfo.Proto == stamps.StampProtoTypeDoH {
 			tid := TransactionID(query)
@@ -444,30 +975,75 @@ func (proxy *Proxy) processIncomingQuery(serverInfo *ServerInfo, clientProto str
 			if err != nil {
 				pluginsState.returnCode = PluginsReturnCodeServerError
 				serverInfo.noticeFailure(proxy)
-				return
+				return nil
 			}
 			response, err = ioutil.ReadAll(io.LimitReader(resp.Body, int64(MaxDNSPacketSize)))
 			if err != nil {
 				pluginsState.returnCode = PluginsReturnCodeServerError
 				serverInfo.noticeFailure(proxy)
-				return
+				return nil
+			}
+			if len(response) >= MinDNSPacketSize {
+				SetTransactionID(response, tid)
+			}
+		} else if serverInfo.Proto == StampProtoTypeODoHTarget {
+			tid := TransactionID(query)
+			SetTransactionID(query, 0)
+			serverInfo.noticeBegin(proxy)
+			response, err = proxy.exchangeWithODoHServer(serverInfo, query, serverInfo.Timeout)
+			SetTransactionID(query, tid)
+			if err != nil {
+				pluginsState.returnCode = PluginsReturnCodeServerError
+				serverInfo.noticeFailure(proxy)
+				return nil
 			}
 			if len(response) >= MinDNSPacketSize {
 				SetTransactionID(response, tid)
 			}
+		} else if serverInfo.Proto == stamps.StampProtoTypeTLS {
+			serverInfo.noticeBegin(proxy)
+			response, err = serverInfo.dotClient.Exchange(query, serverInfo.Timeout)
+			if err != nil {
+				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+					pluginsState.returnCode = PluginsReturnCodeServerTimeout
+				} else {
+					pluginsState.returnCode = PluginsReturnCodeServerError
+				}
+				serverInfo.noticeFailure(proxy)
+				return nil
+			}
+		} else if serverInfo.Proto == stamps.StampProtoTypePlain {
+			serverInfo.noticeBegin(proxy)
+			response, err = proxy.exchangeWithPlainServer(serverInfo, serverProto, query)
+			if err == nil && serverProto == "udp" && HasTCFlag(response) {
+				response, err = proxy.exchangeWithPlainServer(serverInfo, "tcp", query)
+			}
+			if err != nil {
+				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+					pluginsState.returnCode = PluginsReturnCodeServerTimeout
+				} else {
+					pluginsState.returnCode = PluginsReturnCodeServerError
+				}
+				serverInfo.noticeFailure(proxy)
+				return nil
+			}
 		} else {
-			dlog.Fatal("Unsupported protocol")
+			dlog.Criticalf("[%s] Unsupported protocol", serverInfo.Name)
+			pluginsState.returnCode = PluginsReturnCodeServerError
+			return nil
 		}
+		pluginsState.serverRtt = time.Since(exchangeStart)
+		pluginsState.messages.setServerResponse(serverInfo, serverProto, response, exchangeStart.Add(pluginsState.serverRtt))
 		if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
 			pluginsState.returnCode = PluginsReturnCodeParseError
 			serverInfo.noticeFailure(proxy)
-			return
+			return nil
 		}
 		response, err = pluginsState.ApplyResponsePlugins(&proxy.pluginsGlobals, response, ttl)
 		if err != nil {
 			pluginsState.returnCode = PluginsReturnCodeParseError
 			serverInfo.noticeFailure(proxy)
-			return
+			return nil
 		}
 		if rcode := Rcode(response); rcode == dns.RcodeServerFailure { // SERVFAIL
 			dlog.Infof("Server [%v] returned temporary error code [%v] -- Upstream server may be experiencing connectivity issues", serverInfo.Name, rcode)
@@ -475,39 +1051,35 @@ func (proxy *Proxy) processIncomingQuery(serverInfo *ServerInfo, clientProto str
 		} else {
 			serverInfo.noticeSuccess(proxy)
 		}
-	}
-	if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
-		pluginsState.returnCode = PluginsReturnCodeParseError
-		if serverInfo != nil {
-			serverInfo.noticeFailure(proxy)
+		if pluginsState.action == PluginsActionDrop {
+			pluginsState.returnCode = PluginsReturnCodeDrop
+			return nil
 		}
-		return
-	}
-	if clientProto == "udp" {
-		if len(response) > pluginsState.maxUnencryptedUDPSafePayloadSize {
-			response, err = TruncatedResponse(response)
+		if pluginsState.synthResponse != nil {
+			if len(pluginsState.cnameTarget) > 0 && pluginsState.action == PluginsActionSynth {
+				proxy.resolveCNAMETarget(pluginsState, serverInfo, serverProto)
+			}
+			response, err = pluginsState.synthResponse.PackBuffer(response)
 			if err != nil {
 				pluginsState.returnCode = PluginsReturnCodeParseError
-				return
+				return nil
 			}
 		}
-		clientPc.(net.PacketConn).WriteTo(response, *clientAddr)
-		if HasTCFlag(response) {
-			proxy.questionSizeEstimator.blindAdjust()
-		} else {
-			proxy.questionSizeEstimator.adjust(ResponseOverhead + len(response))
-		}
-	} else {
-		response, err = PrefixWithSize(response)
-		if err != nil {
-			pluginsState.returnCode = PluginsReturnCodeParseError
-			if serverInfo != nil {
-				serverInfo.noticeFailure(proxy)
-			}
-			return
+	}
+	if len(response) == 0 && serverInfo == nil && pluginsState.action == PluginsActionForward {
+		// No live servers: this is a server error, so that a stale response can be served
+		pluginsState.returnCode = PluginsReturnCodeServerError
+		return nil
+	}
+	if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
+		pluginsState.returnCode = PluginsReturnCodeParseError
+		if serverInfo != nil {
+			serverInfo.noticeFailure(proxy)
 		}
-		clientPc.Write(response)
+		return nil
 	}
+	pluginsState.messages.setClientResponse(response)
+	return response
 }
 
 func NewProxy() *Proxy {
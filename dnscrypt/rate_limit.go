@@ -0,0 +1,113 @@
+package dnscrypt
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/jedisct1/dlog"
+)
+
+// RateLimitMaxClients is the number of clients whose rate is tracked by a policy, the least recently seen ones being forgotten
+const RateLimitMaxClients = 65536
+
+const (
+	RateLimitActionDrop     = "drop"
+	RateLimitActionRefused  = "refused"
+	RateLimitActionTruncate = "truncate"
+)
+
+// RateLimit is a token bucket policy, applied to every client IP address, or to every prefix if the prefix lengths are shorter.
+// A client can send Burst queries at once, then QueriesPerSecond queries per second on average.
+// A policy with no queries per second doesn't limit anything.
+type RateLimit struct {
+	QueriesPerSecond float64
+	Burst            float64
+	IPv4PrefixLen    int
+	IPv6PrefixLen    int
+	Action           string
+	initOnce         sync.Once
+	lock             sync.Mutex
+	buckets          *simplelru.LRU
+}
+
+type rateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+	limited bool
+}
+
+// clientPrefix returns the address or prefix of a client, masked according to the prefix length of its family
+func (rateLimit *RateLimit) clientPrefix(clientIP net.IP) (net.IP, int) {
+	if clientIP4 := clientIP.To4(); clientIP4 != nil {
+		return clientIP4.Mask(net.CIDRMask(rateLimit.IPv4PrefixLen, 32)), rateLimit.IPv4PrefixLen
+	}
+	return clientIP.Mask(net.CIDRMask(rateLimit.IPv6PrefixLen, 128)), rateLimit.IPv6PrefixLen
+}
+
+// allow takes a token from the bucket of a client, and tells whether its query can be answered.
+// limitStarted is true for the first query of the client to be refused after it was allowed.
+func (rateLimit *RateLimit) allow(clientIP net.IP, now time.Time) (allowed bool, limitStarted bool) {
+	if rateLimit.QueriesPerSecond <= 0 {
+		return true, false
+	}
+	rateLimit.initOnce.Do(func() {
+		rateLimit.buckets, _ = simplelru.NewLRU(RateLimitMaxClients, nil)
+	})
+	prefix, _ := rateLimit.clientPrefix(clientIP)
+	key := string(prefix)
+	rateLimit.lock.Lock()
+	defer rateLimit.lock.Unlock()
+	var bucket *rateLimitBucket
+	if bucketAny, ok := rateLimit.buckets.Get(key); ok {
+		bucket = bucketAny.(*rateLimitBucket)
+		bucket.tokens += now.Sub(bucket.updated).Seconds() * rateLimit.QueriesPerSecond
+		if bucket.tokens > rateLimit.Burst {
+			bucket.tokens = rateLimit.Burst
+		}
+	} else {
+		bucket = &rateLimitBucket{tokens: rateLimit.Burst}
+		rateLimit.buckets.Add(key, bucket)
+	}
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		bucket.limited = false
+		return true, false
+	}
+	limitStarted = !bucket.limited
+	bucket.limited = true
+	return false, limitStarted
+}
+
+// clientRateLimit returns the policy applying to a client: the one of its client group if it has one, or the global one
+func (proxy *Proxy) clientRateLimit(clientIP net.IP) *RateLimit {
+	if clientGroup := findClientGroupByIP(proxy.ClientGroups, clientIP); clientGroup != nil && clientGroup.RateLimit != nil {
+		return clientGroup.RateLimit
+	}
+	return proxy.RateLimit
+}
+
+// rateLimitedQuery returns the policy a query exceeds, or nil if the query can be answered.
+// Queries received over TCP, DoT and DoH are not limited if the policy truncates responses, so that clients can retry using TCP.
+func (proxy *Proxy) rateLimitedQuery(clientAddr net.Addr, stream bool) *RateLimit {
+	clientIP := addrIP(&clientAddr)
+	if clientIP == nil {
+		return nil
+	}
+	rateLimit := proxy.clientRateLimit(clientIP)
+	if rateLimit == nil || (stream && rateLimit.Action == RateLimitActionTruncate) {
+		return nil
+	}
+	allowed, limitStarted := rateLimit.allow(clientIP, time.Now())
+	if allowed {
+		return nil
+	}
+	if limitStarted {
+		prefix, prefixLen := rateLimit.clientPrefix(clientIP)
+		dlog.Noticef("Rate limiting [%s/%d] - Action: [%s]", prefix, prefixLen, rateLimit.Action)
+	}
+	proxy.metrics.countRateLimited(rateLimit.Action)
+	return rateLimit
+}
@@ -0,0 +1,124 @@
+package dnscrypt
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	RulesFilesDebounceDelay = time.Second
+	RulesFilesPollInterval  = 10 * time.Second
+)
+
+// startRulesFilesWatcher reloads plugins when their rules files change.
+// Changes are detected using the notification mechanism of the operating system if available,
+// and by checking the files periodically otherwise.
+func (proxy *Proxy) startRulesFilesWatcher() {
+	filesPlugins := make(map[string][]Plugin)
+	var paths []string
+	for _, plugin := range proxy.plugins() {
+		rulesFilePlugin, ok := plugin.(rulesFilePlugin)
+		if !ok {
+			continue
+		}
+		var fileNames []string
+		if fileName := rulesFilePlugin.rulesFile(); len(fileName) > 0 {
+			fileNames = append(fileNames, fileName)
+		}
+		if additionalRulesFilesPlugin, ok := plugin.(additionalRulesFilesPlugin); ok {
+			fileNames = append(fileNames, additionalRulesFilesPlugin.additionalRulesFiles()...)
+		}
+		for _, fileName := range fileNames {
+			path, err := filepath.Abs(fileName)
+			if err != nil {
+				dlog.Warnf("Unable to watch [%s]: [%s]", fileName, err)
+				continue
+			}
+			filePlugins, found := filesPlugins[path]
+			if !found {
+				paths = append(paths, path)
+			} else if filePlugins[len(filePlugins)-1] == plugin {
+				continue
+			}
+			filesPlugins[path] = append(filePlugins, plugin)
+		}
+	}
+	if len(paths) == 0 {
+		return
+	}
+	changes := make(chan string)
+	if err := proxy.watchRulesFiles(paths, changes); err != nil {
+		dlog.Noticef("Unable to watch the rules files for changes: [%s] - They will be checked every %v instead", err, RulesFilesPollInterval)
+		proxy.goBackground(func() { proxy.pollRulesFiles(paths, changes) })
+	}
+	proxy.goBackground(func() { proxy.reloadChangedRulesFiles(filesPlugins, changes) })
+}
+
+// reloadChangedRulesFiles waits for a burst of changes to be over before reloading the plugins using the changed files
+func (proxy *Proxy) reloadChangedRulesFiles(filesPlugins map[string][]Plugin, changes <-chan string) {
+	pending := make(map[string]bool)
+	timer := time.NewTimer(RulesFilesDebounceDelay)
+	timer.Stop()
+	for {
+		select {
+		case <-proxy.ctx.Done():
+			timer.Stop()
+			return
+		case path := <-changes:
+			if _, found := filesPlugins[path]; !found {
+				continue
+			}
+			dlog.Debugf("[%s] changed", path)
+			pending[path] = true
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(RulesFilesDebounceDelay)
+		case <-timer.C:
+			for path := range pending {
+				for _, plugin := range filesPlugins[path] {
+					proxy.reloadPlugin(plugin)
+				}
+				delete(pending, path)
+			}
+		}
+	}
+}
+
+// pollRulesFiles periodically checks whether the rules files have been modified or replaced
+func (proxy *Proxy) pollRulesFiles(paths []string, changes chan<- string) {
+	previousInfos := make(map[string]os.FileInfo)
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			previousInfos[path] = info
+		}
+	}
+	for {
+		if !proxy.sleep(RulesFilesPollInterval) {
+			return
+		}
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			previousInfo := previousInfos[path]
+			previousInfos[path] = info
+			if previousInfo != nil && os.SameFile(previousInfo, info) &&
+				previousInfo.ModTime().Equal(info.ModTime()) && previousInfo.Size() == info.Size() {
+				continue
+			}
+			select {
+			case changes <- path:
+			case <-proxy.ctx.Done():
+				return
+			}
+		}
+	}
+}
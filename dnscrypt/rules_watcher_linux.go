@@ -0,0 +1,72 @@
+package dnscrypt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchRulesFiles watches the directories containing the rules files with inotify,
+// so that files replaced by a rename are noticed as well.
+// Files are only reloaded once they have been closed after a write, or moved into place.
+func (proxy *Proxy) watchRulesFiles(paths []string, changes chan<- string) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	dirs := make(map[int32]string)
+	watchedDirs := make(map[string]bool)
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if watchedDirs[dir] {
+			continue
+		}
+		wd, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO)
+		if err != nil {
+			unix.Close(fd)
+			return err
+		}
+		dirs[int32(wd)] = dir
+		watchedDirs[dir] = true
+	}
+	inotifyFile := os.NewFile(uintptr(fd), "inotify")
+	if !proxy.addCloser(closerFunc(inotifyFile)) {
+		return nil
+	}
+	proxy.goBackground(func() {
+		buffer := make([]byte, 64*1024)
+		for {
+			length, err := inotifyFile.Read(buffer)
+			if err != nil {
+				return
+			}
+			var changedPaths []string
+			for offset := 0; offset+unix.SizeofInotifyEvent <= length; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				nameOffset := offset + unix.SizeofInotifyEvent
+				offset = nameOffset + int(event.Len)
+				if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+					changedPaths = append(changedPaths, paths...)
+					continue
+				}
+				dir, found := dirs[event.Wd]
+				if !found || event.Len == 0 || offset > length {
+					continue
+				}
+				name := strings.TrimRight(string(buffer[nameOffset:offset]), "\x00")
+				changedPaths = append(changedPaths, filepath.Join(dir, name))
+			}
+			for _, path := range changedPaths {
+				select {
+				case changes <- path:
+				case <-proxy.ctx.Done():
+					return
+				}
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package dnscrypt
+
+import "errors"
+
+func (proxy *Proxy) watchRulesFiles(paths []string, changes chan<- string) error {
+	return errors.New("File change notifications are not supported on this platform")
+}
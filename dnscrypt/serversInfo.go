@@ -2,6 +2,7 @@ package dnscrypt
 
 import (
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -45,10 +46,15 @@ type ServerInfo struct {
 	TCPAddr            *net.TCPAddr
 	RelayUDPAddr       *net.UDPAddr
 	RelayTCPAddr       *net.TCPAddr
+	RelayURL           *url.URL
 	lastActionTS       time.Time
 	rtt                ewma.MovingAverage
 	initialRtt         int
 	useGet             bool
+	connPool           *ConnPool
+	dotClient          *DoTClient
+	odohTargetConfig   *ODoHTargetConfig
+	certNotAfter       time.Time
 }
 
 type LBStrategy int
@@ -65,6 +71,7 @@ const DefaultLBStrategy = LBStrategyP2
 
 type ServersInfo struct {
 	sync.RWMutex
+	refreshLock       sync.Mutex
 	inner             []*ServerInfo
 	registeredServers []RegisteredServer
 	LBStrategy        LBStrategy
@@ -104,14 +111,16 @@ func (serversInfo *ServersInfo) refreshServer(proxy *Proxy, name string, stamp s
 		return err
 	}
 	if name != newServer.Name {
-		dlog.Fatalf("[%s] != [%s]", name, newServer.Name)
+		return fmt.Errorf("[%s] != [%s]", name, newServer.Name)
 	}
 	newServer.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
 	newServer.rtt.Set(float64(newServer.initialRtt))
 	isNew = true
+	var oldServer *ServerInfo
 	serversInfo.Lock()
-	for i, oldServer := range serversInfo.inner {
-		if oldServer.Name == name {
+	for i, server := range serversInfo.inner {
+		if server.Name == name {
+			oldServer = server
 			serversInfo.inner[i] = &newServer
 			isNew = false
 			break
@@ -122,11 +131,16 @@ func (serversInfo *ServersInfo) refreshServer(proxy *Proxy, name string, stamp s
 		serversInfo.registeredServers = append(serversInfo.registeredServers, RegisteredServer{Name: name, Stamp: stamp})
 	}
 	serversInfo.Unlock()
+	if oldServer != nil {
+		oldServer.closeConnections()
+	}
 	return nil
 }
 
 func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
 	dlog.Debug("Refreshing certificates")
+	serversInfo.refreshLock.Lock()
+	defer serversInfo.refreshLock.Unlock()
 	serversInfo.RLock()
 	registeredServers := serversInfo.registeredServers
 	serversInfo.RUnlock()
@@ -152,7 +166,12 @@ func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
 	if innerLen > 0 {
 		dlog.Noticef("Server with the lowest initial latency: %s (rtt: %dms)", inner[0].Name, inner[0].initialRtt)
 	}
+	// Servers accepted the current date, that can now be trusted to check the validity of certificates
+	if liveServers > 0 {
+		proxy.CertIgnoreTimestamp = false
+	}
 	serversInfo.Unlock()
+	proxy.metrics.setLiveServers(liveServers)
 	return liveServers, err
 }
 
@@ -221,74 +240,125 @@ func fetchServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew
 		return fetchDNSCryptServerInfo(proxy, name, stamp, isNew)
 	} else if stamp.Proto == stamps.StampProtoTypeDoH {
 		return fetchDoHServerInfo(proxy, name, stamp, isNew)
+	} else if stamp.Proto == stamps.StampProtoTypeTLS {
+		return fetchDoTServerInfo(proxy, name, stamp, isNew)
+	} else if stamp.Proto == stamps.StampProtoTypePlain {
+		return fetchPlainServerInfo(proxy, name, stamp, isNew)
+	} else if stamp.Proto == StampProtoTypeODoHTarget {
+		return fetchODoHServerInfo(proxy, name, stamp, isNew)
 	}
 	return ServerInfo{}, errors.New("Unsupported protocol")
 }
 
-func route(proxy *Proxy, name string, stamp *stamps.ServerStamp) (*net.UDPAddr, *net.TCPAddr, error) {
+// relayStamp picks one of the relays a server should be reached through, among the ones supporting relayProtos
+func relayStamp(proxy *Proxy, name string, relayProtos ...stamps.StampProtoType) (*stamps.ServerStamp, error) {
 	routes := proxy.Routes
 	if routes == nil {
-		return nil, nil, nil
+		return nil, nil
 	}
 	relayNames, ok := (*routes)[name]
 	if !ok {
 		relayNames, ok = (*routes)["*"]
 	}
 	if !ok {
-		return nil, nil, nil
+		return nil, nil
 	}
-	var relayName string
-	if len(relayNames) > 0 {
-		candidate := rand.Intn(len(relayNames))
-		relayName = relayNames[candidate]
+	if len(relayNames) == 0 {
+		return nil, fmt.Errorf("Route declared for [%v] but an empty relay list", name)
 	}
-	var relayCandidateStamp *stamps.ServerStamp
-	if len(relayName) == 0 {
-		return nil, nil, fmt.Errorf("Route declared for [%v] but an empty relay list", name)
-	} else if relayStamp, err := stamps.NewServerStampFromString(relayName); err == nil {
-		relayCandidateStamp = &relayStamp
-	} else if _, err := net.ResolveUDPAddr("udp", relayName); err == nil {
-		relayCandidateStamp = &stamps.ServerStamp{
-			ServerAddrStr: relayName,
-			Proto:         stamps.StampProtoTypeDNSCryptRelay,
+	var relayCandidateStamps []*stamps.ServerStamp
+	for _, relayName := range relayNames {
+		relayCandidateStamp := lookupRelay(proxy, relayName)
+		if relayCandidateStamp == nil {
+			dlog.Warnf("Undefined relay [%v] for server [%v]", relayName, name)
+			continue
 		}
-	} else {
-		for _, registeredServer := range proxy.RegisteredRelays {
-			if registeredServer.Name == relayName {
-				relayCandidateStamp = &registeredServer.Stamp
+		for _, relayProto := range relayProtos {
+			if relayCandidateStamp.Proto == relayProto {
+				relayCandidateStamps = append(relayCandidateStamps, relayCandidateStamp)
 				break
 			}
 		}
-		for _, registeredServer := range proxy.RegisteredServers {
-			if registeredServer.Name == relayName {
-				relayCandidateStamp = &registeredServer.Stamp
-				break
-			}
+	}
+	if len(relayCandidateStamps) == 0 {
+		return nil, fmt.Errorf("No valid relay for server [%v]", name)
+	}
+	return relayCandidateStamps[rand.Intn(len(relayCandidateStamps))], nil
+}
+
+func lookupRelay(proxy *Proxy, relayName string) *stamps.ServerStamp {
+	if relayStamp, err := NewServerStampFromString(relayName); err == nil {
+		return &relayStamp
+	}
+	if relayURL, err := url.Parse(relayName); err == nil && relayURL.Scheme == "https" && len(relayURL.Host) > 0 {
+		return &stamps.ServerStamp{
+			ProviderName: relayURL.Host,
+			Path:         relayURL.Path,
+			Proto:        StampProtoTypeODoHRelay,
 		}
 	}
-	if relayCandidateStamp == nil {
-		return nil, nil, fmt.Errorf("Undefined relay [%v] for server [%v]", relayName, name)
+	if _, err := net.ResolveUDPAddr("udp", relayName); err == nil {
+		return &stamps.ServerStamp{
+			ServerAddrStr: relayName,
+			Proto:         stamps.StampProtoTypeDNSCryptRelay,
+		}
 	}
-	if relayCandidateStamp.Proto == stamps.StampProtoTypeDNSCrypt ||
-		relayCandidateStamp.Proto == stamps.StampProtoTypeDNSCryptRelay {
-		relayUDPAddr, err := net.ResolveUDPAddr("udp", relayCandidateStamp.ServerAddrStr)
-		if err != nil {
-			return nil, nil, err
+	var relayCandidateStamp *stamps.ServerStamp
+	for _, registeredServer := range proxy.RegisteredRelays {
+		if registeredServer.Name == relayName {
+			relayCandidateStamp = &registeredServer.Stamp
+			break
 		}
-		relayTCPAddr, err := net.ResolveTCPAddr("tcp", relayCandidateStamp.ServerAddrStr)
-		if err != nil {
-			return nil, nil, err
+	}
+	for _, registeredServer := range proxy.RegisteredServers {
+		if registeredServer.Name == relayName {
+			relayCandidateStamp = &registeredServer.Stamp
+			break
 		}
-		return relayUDPAddr, relayTCPAddr, nil
 	}
-	return nil, nil, fmt.Errorf("Invalid relay [%v] for server [%v]", relayName, name)
+	return relayCandidateStamp
+}
+
+func route(proxy *Proxy, name string, stamp *stamps.ServerStamp) (*net.UDPAddr, *net.TCPAddr, error) {
+	relayCandidateStamp, err := relayStamp(proxy, name, stamps.StampProtoTypeDNSCrypt, stamps.StampProtoTypeDNSCryptRelay)
+	if relayCandidateStamp == nil || err != nil {
+		return nil, nil, err
+	}
+	relayUDPAddr, err := net.ResolveUDPAddr("udp", relayCandidateStamp.ServerAddrStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	relayTCPAddr, err := net.ResolveTCPAddr("tcp", relayCandidateStamp.ServerAddrStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return relayUDPAddr, relayTCPAddr, nil
+}
+
+func odohRoute(proxy *Proxy, name string, targetURL *url.URL) (*url.URL, [][]byte, error) {
+	relayCandidateStamp, err := relayStamp(proxy, name, StampProtoTypeODoHRelay)
+	if relayCandidateStamp == nil || err != nil {
+		return nil, nil, err
+	}
+	if len(relayCandidateStamp.ServerAddrStr) > 0 {
+		ipOnly, _ := ExtractHostAndPort(relayCandidateStamp.ServerAddrStr, -1)
+		if ip := ParseIP(ipOnly); ip != nil {
+			proxy.XTransport.saveCachedIP(relayCandidateStamp.ProviderName, ip, -1*time.Second)
+		}
+	}
+	relayURL := &url.URL{
+		Scheme: "https",
+		Host:   relayCandidateStamp.ProviderName,
+		Path:   relayCandidateStamp.Path,
+	}
+	return odohRelayURL(relayURL, targetURL), relayCandidateStamp.Hashes, nil
 }
 
 func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
 	if len(stamp.ServerPk) != ed25519.PublicKeySize {
 		serverPk, err := hex.DecodeString(strings.Replace(string(stamp.ServerPk), ":", "", -1))
 		if err != nil || len(serverPk) != ed25519.PublicKeySize {
-			dlog.Fatalf("Unsupported public key for [%s]: [%s]", name, stamp.ServerPk)
+			return ServerInfo{}, fmt.Errorf("Unsupported public key for [%s]: [%s]", name, stamp.ServerPk)
 		}
 		dlog.Warnf("Public key [%s] shouldn't be hex-encoded any more", string(stamp.ServerPk))
 		stamp.ServerPk = serverPk
@@ -309,6 +379,10 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 	if err != nil {
 		return ServerInfo{}, err
 	}
+	upstreamUDPAddr, upstreamTCPAddr := remoteUDPAddr, remoteTCPAddr
+	if relayUDPAddr != nil {
+		upstreamUDPAddr, upstreamTCPAddr = relayUDPAddr, relayTCPAddr
+	}
 	return ServerInfo{
 		Proto:              stamps.StampProtoTypeDNSCrypt,
 		MagicQuery:         certInfo.MagicQuery,
@@ -322,6 +396,8 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 		RelayUDPAddr:       relayUDPAddr,
 		RelayTCPAddr:       relayTCPAddr,
 		initialRtt:         rtt,
+		connPool:           NewConnPool(proxy, name, upstreamUDPAddr, upstreamTCPAddr),
+		certNotAfter:       certInfo.NotAfter,
 	}, nil
 }
 
@@ -362,17 +438,209 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 		dlog.Warnf("[%s] does not support HTTP/2", name)
 	}
 	dlog.Infof("[%s] TLS version: %x - Protocol: %v - Cipher suite: %v", name, tls.Version, protocol, tls.CipherSuite)
+	if err := verifyCertHashes(proxy, name, tls, stamp.Hashes); err != nil {
+		return ServerInfo{}, err
+	}
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxHTTPBodyLength))
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	if len(respBody) < MinDNSPacketSize || len(respBody) > MaxDNSPacketSize ||
+		respBody[0] != 0xca || respBody[1] != 0xfe || respBody[4] != 0x00 || respBody[5] != 0x01 {
+		return ServerInfo{}, errors.New("Webserver returned an unexpected response")
+	}
+	xrtt := int(rtt.Nanoseconds() / 1000000)
+	if isNew {
+		dlog.Noticef("[%s] OK (DoH) - rtt: %dms", name, xrtt)
+	} else {
+		dlog.Infof("[%s] OK (DoH) - rtt: %dms", name, xrtt)
+	}
+	return ServerInfo{
+		Proto:        stamps.StampProtoTypeDoH,
+		Name:         name,
+		Timeout:      proxy.Timeout,
+		URL:          url,
+		HostName:     stamp.ProviderName,
+		initialRtt:   xrtt,
+		useGet:       useGet,
+		certNotAfter: peerCertNotAfter(tls),
+	}, nil
+}
+
+func fetchDoTServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	serverAddrStr := stamp.ServerAddrStr
+	if len(serverAddrStr) == 0 {
+		host, port := ExtractHostAndPort(stamp.ProviderName, DefaultDoTPort)
+		if err := proxy.XTransport.resolveHost(host); err != nil {
+			return ServerInfo{}, err
+		}
+		if ip, ok := proxy.XTransport.loadCachedIP(host, false); ok {
+			host = ip.String()
+			if ip.To4() == nil {
+				host = "[" + host + "]"
+			}
+		}
+		serverAddrStr = fmt.Sprintf("%s:%d", host, port)
+	}
+	remoteTCPAddr, err := net.ResolveTCPAddr("tcp", serverAddrStr)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	dotClient := NewDoTClient(proxy, name, remoteTCPAddr.String(), stamp.ProviderName, stamp.Hashes)
+	body := []byte{
+		0xca, 0xfe, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x02, 0x00, 0x01, 0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00,
+	}
+	start := time.Now()
+	response, err := dotClient.Exchange(body, proxy.Timeout)
+	if err != nil {
+		dotClient.Close()
+		return ServerInfo{}, err
+	}
+	rtt := time.Since(start)
+	if len(response) < MinDNSPacketSize || response[0] != 0xca || response[1] != 0xfe || response[4] != 0x00 || response[5] != 0x01 {
+		dotClient.Close()
+		return ServerInfo{}, errors.New("Server returned an unexpected response")
+	}
+	xrtt := int(rtt.Nanoseconds() / 1000000)
+	if isNew {
+		dlog.Noticef("[%s] OK (DoT) - rtt: %dms", name, xrtt)
+	} else {
+		dlog.Infof("[%s] OK (DoT) - rtt: %dms", name, xrtt)
+	}
+	return ServerInfo{
+		Proto:        stamps.StampProtoTypeTLS,
+		Name:         name,
+		Timeout:      proxy.Timeout,
+		HostName:     stamp.ProviderName,
+		TCPAddr:      remoteTCPAddr,
+		initialRtt:   xrtt,
+		dotClient:    dotClient,
+		certNotAfter: dotClient.certNotAfter(),
+	}, nil
+}
+
+func fetchPlainServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	remoteUDPAddr, err := net.ResolveUDPAddr("udp", stamp.ServerAddrStr)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	remoteTCPAddr, err := net.ResolveTCPAddr("tcp", stamp.ServerAddrStr)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	serverInfo := ServerInfo{
+		Proto:   stamps.StampProtoTypePlain,
+		Name:    name,
+		Timeout: proxy.Timeout,
+		UDPAddr: remoteUDPAddr,
+		TCPAddr: remoteTCPAddr,
+	}
+	body := []byte{
+		0xca, 0xfe, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x02, 0x00, 0x01, 0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00,
+	}
+	start := time.Now()
+	response, err := proxy.exchangeWithPlainServer(&serverInfo, proxy.MainProto, body)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	rtt := time.Since(start)
+	if len(response) < MinDNSPacketSize || response[0] != 0xca || response[1] != 0xfe || response[4] != 0x00 || response[5] != 0x01 {
+		return ServerInfo{}, errors.New("Server returned an unexpected response")
+	}
+	serverInfo.initialRtt = int(rtt.Nanoseconds() / 1000000)
+	if isNew {
+		dlog.Noticef("[%s] OK (plain DNS, unencrypted) - rtt: %dms", name, serverInfo.initialRtt)
+	} else {
+		dlog.Infof("[%s] OK (plain DNS, unencrypted) - rtt: %dms", name, serverInfo.initialRtt)
+	}
+	return serverInfo, nil
+}
+
+func fetchODoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	targetURL := &url.URL{
+		Scheme: "https",
+		Host:   stamp.ProviderName,
+		Path:   stamp.Path,
+	}
+	relayURL, relayHashes, err := odohRoute(proxy, name, targetURL)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	if relayURL == nil && isNew {
+		dlog.Warnf("No relay configured for the ODoH target [%s] -- Queries sent to it will not be anonymized", name)
+	}
+	targetConfig, err := fetchODoHTargetConfig(proxy, name, targetURL)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	body := []byte{
+		0xca, 0xfe, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x02, 0x00, 0x01, 0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00,
+	}
+	encryptedBody, queryContext, err := targetConfig.encryptQuery(body)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	queryURL := targetURL
+	if relayURL != nil {
+		queryURL = relayURL
+	}
+	resp, rtt, err := proxy.XTransport.ObliviousDoHQuery(queryURL, encryptedBody, proxy.Timeout)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	defer resp.Body.Close()
+	if relayURL != nil {
+		tls := resp.TLS
+		if tls == nil || !tls.HandshakeComplete {
+			return ServerInfo{}, errors.New("TLS handshake failed")
+		}
+		if err := verifyCertHashes(proxy, name, tls, relayHashes); err != nil {
+			return ServerInfo{}, err
+		}
+	}
+	encryptedResponse, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxHTTPBodyLength))
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	respBody, err := queryContext.decryptResponse(encryptedResponse)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	if len(respBody) < MinDNSPacketSize || len(respBody) > MaxDNSPacketSize ||
+		respBody[0] != 0xca || respBody[1] != 0xfe || respBody[4] != 0x00 || respBody[5] != 0x01 {
+		return ServerInfo{}, errors.New("Target returned an unexpected response")
+	}
+	xrtt := int(rtt.Nanoseconds() / 1000000)
+	if isNew {
+		dlog.Noticef("[%s] OK (ODoH) - rtt: %dms", name, xrtt)
+	} else {
+		dlog.Infof("[%s] OK (ODoH) - rtt: %dms", name, xrtt)
+	}
+	return ServerInfo{
+		Proto:            StampProtoTypeODoHTarget,
+		Name:             name,
+		Timeout:          proxy.Timeout,
+		URL:              targetURL,
+		HostName:         stamp.ProviderName,
+		RelayURL:         relayURL,
+		initialRtt:       xrtt,
+		odohTargetConfig: targetConfig,
+	}, nil
+}
+
+// verifyCertHashes checks that a certificate of the chain matches one of the pinned hashes, if there are any
+func verifyCertHashes(proxy *Proxy, name string, state *tls.ConnectionState, hashes [][]byte) error {
 	showCerts := proxy.ShowCerts
 	found := false
 	var wantedHash [32]byte
-	for _, cert := range tls.PeerCertificates {
+	for _, cert := range state.PeerCertificates {
 		h := sha256.Sum256(cert.RawTBSCertificate)
 		if showCerts {
 			dlog.Noticef("Advertised cert: [%s] [%x]", cert.Subject, h)
 		} else {
 			dlog.Debugf("Advertised cert: [%s] [%x]", cert.Subject, h)
 		}
-		for _, hash := range stamp.Hashes {
+		for _, hash := range hashes {
 			if len(hash) == len(wantedHash) {
 				copy(wantedHash[:], hash)
 				if h == wantedHash {
@@ -385,38 +653,35 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 			break
 		}
 	}
-	if !found && len(stamp.Hashes) > 0 {
-		return ServerInfo{}, fmt.Errorf("Certificate hash [%x] not found for [%s]", wantedHash, name)
+	if !found && len(hashes) > 0 {
+		return fmt.Errorf("Certificate hash [%x] not found for [%s]", wantedHash, name)
 	}
-	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxHTTPBodyLength))
-	if err != nil {
-		return ServerInfo{}, err
+	return nil
+}
+
+// peerCertNotAfter returns the expiration date of the certificate presented by a TLS server
+func peerCertNotAfter(state *tls.ConnectionState) time.Time {
+	if len(state.PeerCertificates) == 0 {
+		return time.Time{}
 	}
-	if len(respBody) < MinDNSPacketSize || len(respBody) > MaxDNSPacketSize ||
-		respBody[0] != 0xca || respBody[1] != 0xfe || respBody[4] != 0x00 || respBody[5] != 0x01 {
-		return ServerInfo{}, errors.New("Webserver returned an unexpected response")
+	return state.PeerCertificates[0].NotAfter
+}
+
+// closeConnections releases the persistent connections of a server that has been replaced
+func (serverInfo *ServerInfo) closeConnections() {
+	if serverInfo.connPool != nil {
+		serverInfo.connPool.Close()
 	}
-	xrtt := int(rtt.Nanoseconds() / 1000000)
-	if isNew {
-		dlog.Noticef("[%s] OK (DoH) - rtt: %dms", name, xrtt)
-	} else {
-		dlog.Infof("[%s] OK (DoH) - rtt: %dms", name, xrtt)
+	if serverInfo.dotClient != nil {
+		serverInfo.dotClient.Close()
 	}
-	return ServerInfo{
-		Proto:      stamps.StampProtoTypeDoH,
-		Name:       name,
-		Timeout:    proxy.Timeout,
-		URL:        url,
-		HostName:   stamp.ProviderName,
-		initialRtt: xrtt,
-		useGet:     useGet,
-	}, nil
 }
 
 func (serverInfo *ServerInfo) noticeFailure(proxy *Proxy) {
 	proxy.ServersInfo.Lock()
 	serverInfo.rtt.Add(float64(proxy.Timeout.Nanoseconds() / 1000000))
 	proxy.ServersInfo.Unlock()
+	proxy.metrics.countServerError(serverInfo.Name)
 }
 
 func (serverInfo *ServerInfo) noticeBegin(proxy *Proxy) {
@@ -434,4 +699,5 @@ func (serverInfo *ServerInfo) noticeSuccess(proxy *Proxy) {
 		serverInfo.rtt.Add(float64(elapsedMs))
 	}
 	proxy.ServersInfo.Unlock()
+	proxy.metrics.observeServerRtt(serverInfo.Name, elapsed)
 }
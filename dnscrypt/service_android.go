@@ -6,6 +6,6 @@ func ServiceManagerStartNotify() error {
 	return nil
 }
 
-func ServiceManagerReadyNotify() error {
+func ServiceManagerReadyNotify(done <-chan struct{}) error {
 	return nil
 }
@@ -3,8 +3,9 @@
 package dnscrypt
 
 import (
+	"time"
+
 	"github.com/coreos/go-systemd/daemon"
-	clocksmith "github.com/jedisct1/go-clocksmith"
 )
 
 func ServiceManagerStartNotify() error {
@@ -12,12 +13,14 @@ func ServiceManagerStartNotify() error {
 	return nil
 }
 
-func ServiceManagerReadyNotify() error {
+// ServiceManagerReadyNotify notifies systemd that the service is ready,
+// and keeps the watchdog happy until done is closed
+func ServiceManagerReadyNotify(done <-chan struct{}) error {
 	daemon.SdNotify(false, "READY=1")
-	return systemDWatchdog()
+	return systemDWatchdog(done)
 }
 
-func systemDWatchdog() error {
+func systemDWatchdog(done <-chan struct{}) error {
 	watchdogFailureDelay, err := daemon.SdWatchdogEnabled(false)
 	if err != nil || watchdogFailureDelay == 0 {
 		return err
@@ -29,7 +32,11 @@ func systemDWatchdog() error {
 			// checks program is not totally stuck and can
 			// run this goroutine
 			daemon.SdNotify(false, "WATCHDOG=1")
-			clocksmith.Sleep(refreshInterval)
+			select {
+			case <-done:
+				return
+			case <-time.After(refreshInterval):
+			}
 		}
 
 	}()
@@ -16,7 +16,6 @@ import (
 	"github.com/dchest/safefile"
 
 	"github.com/jedisct1/dlog"
-	stamps "github.com/jedisct1/go-dnsstamps"
 	"github.com/jedisct1/go-minisign"
 )
 
@@ -264,7 +263,7 @@ PartsLoop:
 			appendStampErr("Missing stamp for server [%s]", name)
 			continue
 		}
-		stamp, err := stamps.NewServerStampFromString(stampStr)
+		stamp, err := NewServerStampFromString(stampStr)
 		if err != nil {
 			appendStampErr("Invalid or unsupported stamp [%v]: %s", stampStr, err.Error())
 			continue
@@ -272,7 +271,7 @@ PartsLoop:
 		registeredServer := RegisteredServer{
 			Name: name, Stamp: stamp, Description: description,
 		}
-		dlog.Debugf("Registered [%s] with stamp [%s]", name, stamp.String())
+		dlog.Debugf("Registered [%s] with stamp [%s]", name, ServerStampString(&stamp))
 		registeredServers = append(registeredServers, registeredServer)
 	}
 	if len(stampErrs) > 0 {
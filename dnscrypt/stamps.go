@@ -0,0 +1,402 @@
+package dnscrypt
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+const (
+	DefaultDoTPort   = 853
+	DefaultPlainPort = 53
+)
+
+const (
+	StampProtoTypeODoHTarget = stamps.StampProtoType(0x05)
+	StampProtoTypeODoHRelay  = stamps.StampProtoType(0x85)
+)
+
+// NewServerStampFromString parses a stamp, including the protocols that the
+// dnsstamps package doesn't know how to decode yet
+func NewServerStampFromString(stampStr string) (stamps.ServerStamp, error) {
+	stamp, err := stamps.NewServerStampFromString(stampStr)
+	if err == nil {
+		return stamp, nil
+	}
+	bin, ok := decodeStamp(stampStr)
+	if !ok {
+		return stamp, err
+	}
+	switch stamps.StampProtoType(bin[0]) {
+	case stamps.StampProtoTypeTLS:
+		return newDoTServerStamp(bin)
+	case stamps.StampProtoTypePlain:
+		return newPlainServerStamp(bin)
+	case StampProtoTypeODoHTarget:
+		return newODoHTargetStamp(bin)
+	case StampProtoTypeODoHRelay:
+		return newODoHRelayStamp(bin)
+	}
+	return stamp, err
+}
+
+func decodeStamp(stampStr string) ([]byte, bool) {
+	if !strings.HasPrefix(stampStr, "sdns:") {
+		return nil, false
+	}
+	stampStr = strings.TrimPrefix(stampStr[5:], "//")
+	bin, err := base64.RawURLEncoding.Strict().DecodeString(stampStr)
+	if err != nil || len(bin) < 1 {
+		return nil, false
+	}
+	return bin, true
+}
+
+// id(u8)=0x03 props addrLen(1) serverAddr hashLen(1) hash providerNameLen(1) providerName
+
+func newDoTServerStamp(bin []byte) (stamps.ServerStamp, error) {
+	stamp := stamps.ServerStamp{Proto: stamps.StampProtoTypeTLS}
+	if len(bin) < 12 {
+		return stamp, errors.New("Stamp is too short")
+	}
+	stamp.Props = stamps.ServerInformalProperties(binary.LittleEndian.Uint64(bin[1:9]))
+	binLen := len(bin)
+	pos := 9
+
+	length := int(bin[pos])
+	if 1+length >= binLen-pos {
+		return stamp, errors.New("Invalid stamp")
+	}
+	pos++
+	stamp.ServerAddrStr = string(bin[pos : pos+length])
+	pos += length
+
+	for {
+		vlen := int(bin[pos])
+		length = vlen & ^0x80
+		if 1+length >= binLen-pos {
+			return stamp, errors.New("Invalid stamp")
+		}
+		pos++
+		if length > 0 {
+			stamp.Hashes = append(stamp.Hashes, bin[pos:pos+length])
+		}
+		pos += length
+		if vlen&0x80 != 0x80 {
+			break
+		}
+	}
+
+	length = int(bin[pos])
+	if length >= binLen-pos {
+		return stamp, errors.New("Invalid stamp")
+	}
+	pos++
+	stamp.ProviderName = string(bin[pos : pos+length])
+	pos += length
+
+	if pos != binLen {
+		return stamp, errors.New("Invalid stamp (garbage after end)")
+	}
+	if len(stamp.ProviderName) == 0 {
+		return stamp, errors.New("Invalid stamp (missing host name)")
+	}
+	if len(stamp.ServerAddrStr) > 0 {
+		serverAddrStr, err := normalizeStampAddr(stamp.ServerAddrStr, DefaultDoTPort)
+		if err != nil {
+			return stamp, err
+		}
+		stamp.ServerAddrStr = serverAddrStr
+	}
+	return stamp, nil
+}
+
+// id(u8)=0x00 props addrLen(1) serverAddr
+
+func newPlainServerStamp(bin []byte) (stamps.ServerStamp, error) {
+	stamp := stamps.ServerStamp{Proto: stamps.StampProtoTypePlain}
+	if len(bin) < 17 {
+		return stamp, errors.New("Stamp is too short")
+	}
+	stamp.Props = stamps.ServerInformalProperties(binary.LittleEndian.Uint64(bin[1:9]))
+	binLen := len(bin)
+	pos := 9
+
+	length := int(bin[pos])
+	if 1+length > binLen-pos {
+		return stamp, errors.New("Invalid stamp")
+	}
+	pos++
+	stamp.ServerAddrStr = string(bin[pos : pos+length])
+	pos += length
+
+	if pos != binLen {
+		return stamp, errors.New("Invalid stamp (garbage after end)")
+	}
+	serverAddrStr, err := normalizeStampAddr(stamp.ServerAddrStr, DefaultPlainPort)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.ServerAddrStr = serverAddrStr
+	return stamp, nil
+}
+
+// id(u8)=0x05 props hostNameLen(1) hostName pathLen(1) path
+
+func newODoHTargetStamp(bin []byte) (stamps.ServerStamp, error) {
+	stamp := stamps.ServerStamp{Proto: StampProtoTypeODoHTarget}
+	if len(bin) < 12 {
+		return stamp, errors.New("Stamp is too short")
+	}
+	stamp.Props = stamps.ServerInformalProperties(binary.LittleEndian.Uint64(bin[1:9]))
+	binLen := len(bin)
+	pos := 9
+
+	length := int(bin[pos])
+	if 1+length >= binLen-pos {
+		return stamp, errors.New("Invalid stamp")
+	}
+	pos++
+	stamp.ProviderName = string(bin[pos : pos+length])
+	pos += length
+
+	length = int(bin[pos])
+	if length >= binLen-pos {
+		return stamp, errors.New("Invalid stamp")
+	}
+	pos++
+	stamp.Path = string(bin[pos : pos+length])
+	pos += length
+
+	if pos != binLen {
+		return stamp, errors.New("Invalid stamp (garbage after end)")
+	}
+	if len(stamp.ProviderName) == 0 {
+		return stamp, errors.New("Invalid stamp (missing host name)")
+	}
+	return stamp, nil
+}
+
+// id(u8)=0x85 props addrLen(1) serverAddr hashLen(1) hash hostNameLen(1) hostName pathLen(1) path [bootstrapLen(1) bootstrap]
+
+func newODoHRelayStamp(bin []byte) (stamps.ServerStamp, error) {
+	stamp := stamps.ServerStamp{Proto: StampProtoTypeODoHRelay}
+	if len(bin) < 13 {
+		return stamp, errors.New("Stamp is too short")
+	}
+	stamp.Props = stamps.ServerInformalProperties(binary.LittleEndian.Uint64(bin[1:9]))
+	binLen := len(bin)
+	pos := 9
+
+	length := int(bin[pos])
+	if 1+length >= binLen-pos {
+		return stamp, errors.New("Invalid stamp")
+	}
+	pos++
+	stamp.ServerAddrStr = string(bin[pos : pos+length])
+	pos += length
+
+	for {
+		vlen := int(bin[pos])
+		length = vlen & ^0x80
+		if 1+length >= binLen-pos {
+			return stamp, errors.New("Invalid stamp")
+		}
+		pos++
+		if length > 0 {
+			stamp.Hashes = append(stamp.Hashes, bin[pos:pos+length])
+		}
+		pos += length
+		if vlen&0x80 != 0x80 {
+			break
+		}
+	}
+
+	length = int(bin[pos])
+	if 1+length >= binLen-pos {
+		return stamp, errors.New("Invalid stamp")
+	}
+	pos++
+	stamp.ProviderName = string(bin[pos : pos+length])
+	pos += length
+
+	length = int(bin[pos])
+	if length >= binLen-pos {
+		return stamp, errors.New("Invalid stamp")
+	}
+	pos++
+	stamp.Path = string(bin[pos : pos+length])
+	pos += length
+
+	// Bootstrap resolvers are optional, and not used
+	for pos < binLen {
+		vlen := int(bin[pos])
+		length = vlen & ^0x80
+		if length >= binLen-pos {
+			return stamp, errors.New("Invalid stamp")
+		}
+		pos += 1 + length
+		if vlen&0x80 != 0x80 {
+			break
+		}
+	}
+
+	if pos != binLen {
+		return stamp, errors.New("Invalid stamp (garbage after end)")
+	}
+	if len(stamp.ProviderName) == 0 {
+		return stamp, errors.New("Invalid stamp (missing host name)")
+	}
+	if len(stamp.ServerAddrStr) > 0 {
+		serverAddrStr, err := normalizeStampAddr(stamp.ServerAddrStr, stamps.DefaultPort)
+		if err != nil {
+			return stamp, err
+		}
+		stamp.ServerAddrStr = serverAddrStr
+	}
+	return stamp, nil
+}
+
+func normalizeStampAddr(serverAddrStr string, defaultPort int) (string, error) {
+	colIndex := strings.LastIndex(serverAddrStr, ":")
+	bracketIndex := strings.LastIndex(serverAddrStr, "]")
+	if colIndex < bracketIndex {
+		colIndex = -1
+	}
+	if colIndex < 0 {
+		colIndex = len(serverAddrStr)
+		serverAddrStr = fmt.Sprintf("%s:%d", serverAddrStr, defaultPort)
+	}
+	if colIndex >= len(serverAddrStr)-1 {
+		return serverAddrStr, errors.New("Invalid stamp (empty port)")
+	}
+	ipOnly := serverAddrStr[:colIndex]
+	portOnly := serverAddrStr[colIndex+1:]
+	if _, err := strconv.ParseUint(portOnly, 10, 16); err != nil {
+		return serverAddrStr, errors.New("Invalid stamp (port range)")
+	}
+	if net.ParseIP(strings.TrimRight(strings.TrimLeft(ipOnly, "["), "]")) == nil {
+		return serverAddrStr, errors.New("Invalid stamp (IP address)")
+	}
+	return serverAddrStr, nil
+}
+
+// ServerStampString encodes a stamp, including the protocols that the
+// dnsstamps package doesn't know how to encode yet
+func ServerStampString(stamp *stamps.ServerStamp) string {
+	switch stamp.Proto {
+	case stamps.StampProtoTypeTLS:
+		return dotStampString(stamp)
+	case stamps.StampProtoTypePlain:
+		return plainStampString(stamp)
+	case StampProtoTypeODoHTarget:
+		return odohTargetStampString(stamp)
+	case StampProtoTypeODoHRelay:
+		return odohRelayStampString(stamp)
+	}
+	return stamp.String()
+}
+
+func dotStampString(stamp *stamps.ServerStamp) string {
+	bin := make([]uint8, 9)
+	bin[0] = uint8(stamps.StampProtoTypeTLS)
+	binary.LittleEndian.PutUint64(bin[1:9], uint64(stamp.Props))
+
+	serverAddrStr := strings.TrimSuffix(stamp.ServerAddrStr, ":"+strconv.Itoa(DefaultDoTPort))
+	bin = append(bin, uint8(len(serverAddrStr)))
+	bin = append(bin, []uint8(serverAddrStr)...)
+
+	last := len(stamp.Hashes) - 1
+	for i, hash := range stamp.Hashes {
+		vlen := len(hash)
+		if i < last {
+			vlen |= 0x80
+		}
+		bin = append(bin, uint8(vlen))
+		bin = append(bin, hash...)
+	}
+	if last < 0 {
+		bin = append(bin, 0)
+	}
+
+	bin = append(bin, uint8(len(stamp.ProviderName)))
+	bin = append(bin, []uint8(stamp.ProviderName)...)
+
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+func plainStampString(stamp *stamps.ServerStamp) string {
+	bin := make([]uint8, 9)
+	bin[0] = uint8(stamps.StampProtoTypePlain)
+	binary.LittleEndian.PutUint64(bin[1:9], uint64(stamp.Props))
+
+	serverAddrStr := strings.TrimSuffix(stamp.ServerAddrStr, ":"+strconv.Itoa(DefaultPlainPort))
+	bin = append(bin, uint8(len(serverAddrStr)))
+	bin = append(bin, []uint8(serverAddrStr)...)
+
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+func odohTargetStampString(stamp *stamps.ServerStamp) string {
+	bin := make([]uint8, 9)
+	bin[0] = uint8(StampProtoTypeODoHTarget)
+	binary.LittleEndian.PutUint64(bin[1:9], uint64(stamp.Props))
+
+	bin = append(bin, uint8(len(stamp.ProviderName)))
+	bin = append(bin, []uint8(stamp.ProviderName)...)
+
+	bin = append(bin, uint8(len(stamp.Path)))
+	bin = append(bin, []uint8(stamp.Path)...)
+
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+func odohRelayStampString(stamp *stamps.ServerStamp) string {
+	bin := make([]uint8, 9)
+	bin[0] = uint8(StampProtoTypeODoHRelay)
+	binary.LittleEndian.PutUint64(bin[1:9], uint64(stamp.Props))
+
+	serverAddrStr := strings.TrimSuffix(stamp.ServerAddrStr, ":"+strconv.Itoa(stamps.DefaultPort))
+	bin = append(bin, uint8(len(serverAddrStr)))
+	bin = append(bin, []uint8(serverAddrStr)...)
+
+	last := len(stamp.Hashes) - 1
+	for i, hash := range stamp.Hashes {
+		vlen := len(hash)
+		if i < last {
+			vlen |= 0x80
+		}
+		bin = append(bin, uint8(vlen))
+		bin = append(bin, hash...)
+	}
+	if last < 0 {
+		bin = append(bin, 0)
+	}
+
+	bin = append(bin, uint8(len(stamp.ProviderName)))
+	bin = append(bin, []uint8(stamp.ProviderName)...)
+
+	bin = append(bin, uint8(len(stamp.Path)))
+	bin = append(bin, []uint8(stamp.Path)...)
+
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+// StampProtoString returns a printable name for a protocol
+func StampProtoString(proto stamps.StampProtoType) string {
+	switch proto {
+	case stamps.StampProtoTypeTLS:
+		return "DoT"
+	case StampProtoTypeODoHTarget:
+		return "ODoH"
+	case StampProtoTypeODoHRelay:
+		return "ODoH relay"
+	}
+	return proto.String()
+}
@@ -0,0 +1,85 @@
+package dnscrypt
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+func TestServerStampRoundTrip(t *testing.T) {
+	hash := make([]byte, 32)
+	for i := range hash {
+		hash[i] = byte(i)
+	}
+	props := stamps.ServerInformalPropertyDNSSEC | stamps.ServerInformalPropertyNoLog
+	for _, stamp := range []stamps.ServerStamp{
+		{Proto: stamps.StampProtoTypeTLS, Props: props, ServerAddrStr: "9.9.9.9:853", ProviderName: "dns.quad9.net"},
+		{Proto: stamps.StampProtoTypeTLS, ServerAddrStr: "[2620:fe::fe]:8853", Hashes: [][]byte{hash, hash[:16]}, ProviderName: "dns.quad9.net"},
+		{Proto: stamps.StampProtoTypeTLS, ProviderName: "dns.example.com:8853"},
+		{Proto: stamps.StampProtoTypePlain, Props: props, ServerAddrStr: "192.0.2.53:53"},
+		{Proto: stamps.StampProtoTypePlain, ServerAddrStr: "[2001:db8::53]:5353"},
+		{Proto: StampProtoTypeODoHTarget, Props: props, ProviderName: "odoh.example.com", Path: "/dns-query"},
+		{Proto: StampProtoTypeODoHTarget, ProviderName: "odoh.example.com:8443"},
+		{Proto: StampProtoTypeODoHRelay, Props: props, ServerAddrStr: "192.0.2.1:443", Hashes: [][]byte{hash}, ProviderName: "relay.example.com", Path: "/proxy"},
+		{Proto: StampProtoTypeODoHRelay, ProviderName: "relay.example.com", Path: "/proxy"},
+	} {
+		stampStr := ServerStampString(&stamp)
+		decoded, err := NewServerStampFromString(stampStr)
+		if err != nil {
+			t.Errorf("%s stamp [%s]: %v", StampProtoString(stamp.Proto), stampStr, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, stamp) {
+			t.Errorf("%s stamp [%s] decoded as %+v, expected %+v", StampProtoString(stamp.Proto), stampStr, decoded, stamp)
+		}
+		if reencoded := ServerStampString(&decoded); reencoded != stampStr {
+			t.Errorf("%s stamp [%s] reencoded as [%s]", StampProtoString(stamp.Proto), stampStr, reencoded)
+		}
+	}
+}
+
+func TestServerStampDefaultPorts(t *testing.T) {
+	for _, test := range []struct {
+		stamp         stamps.ServerStamp
+		serverAddrStr string
+	}{
+		{stamps.ServerStamp{Proto: stamps.StampProtoTypeTLS, ServerAddrStr: "9.9.9.9", ProviderName: "dns.quad9.net"}, "9.9.9.9:853"},
+		{stamps.ServerStamp{Proto: stamps.StampProtoTypePlain, ServerAddrStr: "192.0.2.53"}, "192.0.2.53:53"},
+		{stamps.ServerStamp{Proto: stamps.StampProtoTypePlain, ServerAddrStr: "[2001:db8::53]"}, "[2001:db8::53]:53"},
+		{stamps.ServerStamp{Proto: StampProtoTypeODoHRelay, ServerAddrStr: "192.0.2.1", ProviderName: "relay.example.com"}, "192.0.2.1:443"},
+	} {
+		decoded, err := NewServerStampFromString(ServerStampString(&test.stamp))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if decoded.ServerAddrStr != test.serverAddrStr {
+			t.Errorf("Unexpected address for [%s]: [%s]", test.stamp.ServerAddrStr, decoded.ServerAddrStr)
+		}
+	}
+}
+
+func TestServerStampInvalid(t *testing.T) {
+	for _, stamp := range []stamps.ServerStamp{
+		{Proto: stamps.StampProtoTypeTLS, ServerAddrStr: "9.9.9.9:853", ProviderName: "dns.quad9.net"},
+		{Proto: stamps.StampProtoTypePlain, ServerAddrStr: "192.0.2.53:53"},
+		{Proto: StampProtoTypeODoHTarget, ProviderName: "odoh.example.com", Path: "/dns-query"},
+		{Proto: StampProtoTypeODoHRelay, ServerAddrStr: "192.0.2.1:443", ProviderName: "relay.example.com", Path: "/proxy"},
+	} {
+		bin, ok := decodeStamp(ServerStampString(&stamp))
+		if !ok {
+			t.Fatal("Unable to decode a stamp")
+		}
+		for _, invalid := range [][]byte{bin[:len(bin)-1], append(append([]byte{}, bin...), 5)} {
+			stampStr := "sdns://" + base64.RawURLEncoding.EncodeToString(invalid)
+			if _, err := NewServerStampFromString(stampStr); err == nil {
+				t.Errorf("Invalid %s stamp [%s] accepted", StampProtoString(stamp.Proto), stampStr)
+			}
+		}
+	}
+	if _, err := NewServerStampFromString(ServerStampString(&stamps.ServerStamp{Proto: stamps.StampProtoTypePlain, ServerAddrStr: "not-an-ip"})); err == nil {
+		t.Error("Plain stamp with a host name accepted")
+	}
+}
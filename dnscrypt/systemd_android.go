@@ -2,11 +2,6 @@
 
 package dnscrypt
 
-import (
-	"io"
-	"io/ioutil"
-)
-
-func (proxy *Proxy) SystemDListeners() (io.Closer, error) {
-	return ioutil.NopCloser(nil), nil
+func (proxy *Proxy) SystemDListeners() error {
+	return nil
 }
@@ -367,6 +367,11 @@ func (xTransport *XTransport) DoHQuery(useGet bool, url *url.URL, body []byte, t
 	return xTransport.Post(url, dataType, dataType, &body, timeout, padding)
 }
 
+func (xTransport *XTransport) ObliviousDoHQuery(url *url.URL, body []byte, timeout time.Duration) (*http.Response, time.Duration, error) {
+	dataType := "application/oblivious-dns-message"
+	return xTransport.Post(url, dataType, dataType, &body, timeout, nil)
+}
+
 func (xTransport *XTransport) makePad(padLen int) *string {
 	if padLen <= 0 {
 		return nil